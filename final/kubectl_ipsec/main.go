@@ -0,0 +1,165 @@
+// kubectl-ipsec: kubectl plugin showing the tunnel of a pod, its SAs,
+// selectors, virtual IP and recent IKE errors. It finds the node of the pod,
+// then asks the strongswan daemon running there for /tunnel through the API
+// server proxy, so it only needs kubectl and access to the daemon pods.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+)
+
+// What the daemon reports on /tunnel
+type tunnel struct {
+	ID          string   `json:"id"`
+	ContainerID string   `json:"containerID"`
+	Namespace   string   `json:"namespace"`
+	Pod         string   `json:"pod"`
+	Network     string   `json:"network"`
+	ServerIP    string   `json:"serverIP"`
+	IPs         []net.IP `json:"ips"`
+	Handshake   float64  `json:"handshakeSeconds"`
+	IKE         []string `json:"ike"`
+	Children    []struct {
+		Name   string   `json:"name"`
+		State  string   `json:"state"`
+		Local  []string `json:"local"`
+		Remote []string `json:"remote"`
+	} `json:"children"`
+	VirtualIPs []string `json:"virtualIPs"`
+	Errors     []string `json:"errors"`
+}
+
+func main() {
+	flags := flag.NewFlagSet("kubectl-ipsec", flag.ExitOnError)
+	namespace := flags.String("n", "", "namespace of the pod, the one of the current context by default")
+	output := flags.String("o", "", "json to print what the daemon reports as is")
+	daemonNamespace := flags.String("daemon-namespace", "kube-system", "namespace of the strongswan daemon pods")
+	daemonSelector := flags.String("daemon-selector", "app=strongswan-cni", "label selector of the strongswan daemon pods")
+	port := flags.Int("port", 9731, "port the daemon listens on")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kubectl ipsec [-n namespace] [-o json] <pod>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flags.Arg(0), *namespace, *output, *daemonNamespace, *daemonSelector, *port); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(pod, namespace, output, daemonNamespace, daemonSelector string, port int) error {
+	if namespace == "" {
+		ns, err := kubectl("config", "view", "--minify", "-o", "jsonpath={..namespace}")
+		if err != nil {
+			return err
+		}
+		if namespace = string(ns); namespace == "" {
+			namespace = "default"
+		}
+	}
+
+	node, err := kubectl("get", "pod", pod, "-n", namespace, "-o", "jsonpath={.spec.nodeName}")
+	if err != nil {
+		return err
+	}
+	if len(node) == 0 {
+		return fmt.Errorf("pod %s/%s isn't scheduled yet", namespace, pod)
+	}
+	daemon, err := kubectl("get", "pods", "-n", daemonNamespace, "-l", daemonSelector,
+		"--field-selector", "spec.nodeName="+string(node), "-o", "jsonpath={.items[0].metadata.name}")
+	if err != nil {
+		return err
+	}
+	if len(daemon) == 0 {
+		return fmt.Errorf("no daemon pod matching %q on node %s", daemonSelector, node)
+	}
+
+	query := url.Values{"namespace": {namespace}, "pod": {pod}}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s:%d/proxy/tunnel?%s", daemonNamespace, daemon, port, query.Encode())
+	data, err := kubectl("get", "--raw", path)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		os.Stdout.Write(append(data, '\n'))
+		return nil
+	}
+
+	var t tunnel
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fmt.Errorf("invalid answer from %s: %v", daemon, err)
+	}
+	printTunnel(&t, string(node))
+	return nil
+}
+
+func printTunnel(t *tunnel, node string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	var ips []string
+	for _, ip := range t.IPs {
+		ips = append(ips, ip.String())
+	}
+	fmt.Fprintf(w, "Pod:\t%s/%s\n", t.Namespace, t.Pod)
+	fmt.Fprintf(w, "Node:\t%s\n", node)
+	fmt.Fprintf(w, "Container:\t%s\n", t.ContainerID)
+	fmt.Fprintf(w, "Network:\t%s\n", t.Network)
+	fmt.Fprintf(w, "Gateway:\t%s\n", t.ServerIP)
+	fmt.Fprintf(w, "Pod IPs:\t%s\n", strings.Join(ips, ", "))
+	fmt.Fprintf(w, "Virtual IPs:\t%s\n", orNone(strings.Join(t.VirtualIPs, ", ")))
+	if t.Handshake > 0 {
+		fmt.Fprintf(w, "Last handshake:\t%.3fs\n", t.Handshake)
+	}
+
+	fmt.Fprintf(w, "IKE_SAs:\t%d\n", len(t.IKE))
+	for _, ike := range t.IKE {
+		fmt.Fprintf(w, "  %s\n", ike)
+	}
+	fmt.Fprintf(w, "CHILD_SAs:\t%d\n", len(t.Children))
+	for _, c := range t.Children {
+		fmt.Fprintf(w, "  %s\t%s\t%s === %s\n", c.Name, c.State, strings.Join(c.Local, " "), strings.Join(c.Remote, " "))
+	}
+	if len(t.Errors) > 0 {
+		fmt.Fprintln(w, "Recent errors:")
+		for _, e := range t.Errors {
+			fmt.Fprintf(w, "  %s\n", e)
+		}
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+// Run kubectl, returning its trimmed output, its error output as the error
+func kubectl(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return nil, fmt.Errorf("kubectl %s: %v", strings.Join(args, " "), err)
+	}
+	return bytes.TrimSpace(stdout.Bytes()), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const acctChain = "STRONGSWAN-ACCT"
+
+// Tunnel traffic of a pod, as seen by the host: everything between the pod
+// and the VPN server, so ESP and IKE, in bytes and packets
+type podTraffic struct {
+	TxBytes   uint64 `json:"txBytes"`
+	RxBytes   uint64 `json:"rxBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	RxPackets uint64 `json:"rxPackets"`
+}
+
+// The traffic of each pod is counted by two RETURN rules in the mangle
+// FORWARD path, one per direction. Masquerading happens after it for the
+// traffic of the pod and is undone before it for the traffic to the pod, so
+// the rules always see the pod addresses. They need a target: without one,
+// the target column of iptables -L is empty and Stats shifts the comment out
+// of the options.
+func acctRules(s *tunnelState, ip net.IP) map[string][]string {
+	pod, server := ip.String(), s.VPN.ServerIP
+	return map[string][]string{
+		"tx": {"-s", pod, "-d", server, "-m", "comment", "--comment", fmt.Sprintf("strongswan-cni %s tx", s.ID), "-j", "RETURN"},
+		"rx": {"-s", server, "-d", pod, "-m", "comment", "--comment", fmt.Sprintf("strongswan-cni %s rx", s.ID), "-j", "RETURN"},
+	}
+}
+
+// Addresses of the pod in the family of the server
+func acctIPs(s *tunnelState) []net.IP {
+	v6 := net.ParseIP(s.VPN.ServerIP).To4() == nil
+	var ips []net.IP
+	for _, ip := range s.IPs {
+		if (ip.To4() == nil) == v6 {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func startAccounting(n *NetConf, s *tunnelState) error {
+	if !n.Accounting {
+		return nil
+	}
+	ipt, err := hostFirewallIPTables(s.VPN.ServerIP)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	if err := ensureChain(ipt, "mangle", acctChain); err != nil {
+		return err
+	}
+	if err := ipt.AppendUnique("mangle", "FORWARD", "-j", acctChain); err != nil {
+		return err
+	}
+	for _, ip := range acctIPs(s) {
+		for _, rule := range acctRules(s, ip) {
+			if err := ipt.AppendUnique("mangle", acctChain, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remove the rules of a pod, whatever accounting is set to now
+func stopAccounting(s *tunnelState) error {
+	ipt, err := hostFirewallIPTables(s.VPN.ServerIP)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	exists, err := chainExists(ipt, "mangle", acctChain)
+	if err != nil || !exists {
+		return err
+	}
+	for _, ip := range acctIPs(s) {
+		for _, rule := range acctRules(s, ip) {
+			exists, err := ipt.Exists("mangle", acctChain, rule...)
+			if err != nil {
+				return err
+			}
+			if exists {
+				if err := ipt.Delete("mangle", acctChain, rule...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var acctCommentRegexp = regexp.MustCompile(`/\* strongswan-cni (\S+) (tx|rx) \*/`)
+
+// Read the counters of every pod, by tunnel id
+func readAccounting() (map[string]*podTraffic, error) {
+	traffic := make(map[string]*podTraffic)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		exists, err := chainExists(ipt, "mangle", acctChain)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		rows, err := ipt.Stats("mangle", acctChain)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			m := acctCommentRegexp.FindStringSubmatch(row[9])
+			if m == nil {
+				continue
+			}
+			packets, _ := strconv.ParseUint(row[0], 10, 64)
+			bytes, _ := strconv.ParseUint(row[1], 10, 64)
+			t := traffic[m[1]]
+			if t == nil {
+				t = &podTraffic{}
+				traffic[m[1]] = t
+			}
+			if m[2] == "tx" {
+				t.TxBytes += bytes
+				t.TxPackets += packets
+			} else {
+				t.RxBytes += bytes
+				t.RxPackets += packets
+			}
+		}
+	}
+	return traffic, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Audit trail of the SAs of every pod. charon of each pod logs IKE and
+// CHILD_SA events into its own file, which is turned into one JSON record per
+// establishment, rekey and teardown in the audit log. Conversion happens on
+// DEL and with the audit command, and picks up where it stopped last time.
+const charonLogFileName = "%s.charon.log"
+
+var charonLogDir = writablePath("/var/log/strongswan-cni")
+
+type auditRecord struct {
+	Time        string `json:"time"`
+	ContainerID string `json:"containerID"`
+	NetNS       string `json:"netns"`
+	Event       string `json:"event"`
+	SA          string `json:"sa"`
+	Peer        string `json:"peer,omitempty"`
+	PeerID      string `json:"peerID,omitempty"`
+	Proposal    string `json:"proposal,omitempty"`
+	SPIIn       string `json:"spiIn,omitempty"`
+	SPIOut      string `json:"spiOut,omitempty"`
+	TS          string `json:"ts,omitempty"`
+}
+
+var (
+	charonLogRegexp  = regexp.MustCompile(`^(\S+) \d+\[\w+\] (.*)$`)
+	proposalRegexp   = regexp.MustCompile(`^selected proposal: (\S+)`)
+	ikeUpRegexp      = regexp.MustCompile(`^IKE_SA (\S+) established between \S+\.\.\.([^\[]+)\[([^\]]*)\]`)
+	ikeDownRegexp    = regexp.MustCompile(`^deleting IKE_SA (\S+) between \S+\.\.\.([^\[]+)\[([^\]]*)\]`)
+	childUpRegexp    = regexp.MustCompile(`^CHILD_SA (\S+) established with SPIs (\w+)_i (\w+)_o and TS (.*)$`)
+	childDownRegexp  = regexp.MustCompile(`^closing CHILD_SA (\S+) with SPIs (\w+)_i .* (\w+)_o .* and TS (.*)$`)
+	childRekeyRegexp = regexp.MustCompile(`^rekeying CHILD_SA`)
+	ikeRekeyedRegexp = regexp.MustCompile(`^IKE_SA (\S+) rekeyed between \S+\.\.\.([^\[]+)\[([^\]]*)\]`)
+)
+
+func charonLogPath(id string) string {
+	return filepath.Join(charonLogDir, fmt.Sprintf(charonLogFileName, id))
+}
+
+// Append the audit records of the charon log of s logged since the last call
+func flushAudit(s *tunnelState) error {
+	if s.AuditLog == "" {
+		return nil
+	}
+
+	logPath := charonLogPath(s.ID)
+	f, err := os.Open(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	offsetPath := logPath + ".offset"
+	var offset int64
+	if data, err := ioutil.ReadFile(offsetPath); err == nil {
+		offset, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(s.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	enc := json.NewEncoder(out)
+
+	var proposal string
+	rekeyingChild := false
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Leave a partially written line for the next run
+			break
+		}
+		offset += int64(len(line))
+
+		m := charonLogRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		r := &auditRecord{Time: m[1], ContainerID: s.ContainerID, NetNS: s.NetNS}
+		msg := m[2]
+
+		switch {
+		case proposalRegexp.MatchString(msg):
+			proposal = proposalRegexp.FindStringSubmatch(msg)[1]
+			continue
+		case childRekeyRegexp.MatchString(msg):
+			rekeyingChild = true
+			continue
+		case ikeUpRegexp.MatchString(msg):
+			sm := ikeUpRegexp.FindStringSubmatch(msg)
+			r.Event, r.SA, r.Peer, r.PeerID = "ike_established", sm[1], sm[2], sm[3]
+			r.Proposal, proposal = proposal, ""
+		case ikeRekeyedRegexp.MatchString(msg):
+			sm := ikeRekeyedRegexp.FindStringSubmatch(msg)
+			r.Event, r.SA, r.Peer, r.PeerID = "ike_rekeyed", sm[1], sm[2], sm[3]
+			r.Proposal, proposal = proposal, ""
+		case ikeDownRegexp.MatchString(msg):
+			sm := ikeDownRegexp.FindStringSubmatch(msg)
+			r.Event, r.SA, r.Peer, r.PeerID = "ike_deleted", sm[1], sm[2], sm[3]
+		case childUpRegexp.MatchString(msg):
+			sm := childUpRegexp.FindStringSubmatch(msg)
+			r.Event = "child_established"
+			if rekeyingChild {
+				r.Event, rekeyingChild = "child_rekeyed", false
+			}
+			r.SA, r.SPIIn, r.SPIOut, r.TS = sm[1], sm[2], sm[3], sm[4]
+			r.Proposal, proposal = proposal, ""
+		case childDownRegexp.MatchString(msg):
+			sm := childDownRegexp.FindStringSubmatch(msg)
+			r.Event, r.SA, r.SPIIn, r.SPIOut, r.TS = "child_closed", sm[1], sm[2], sm[3], sm[4]
+		default:
+			continue
+		}
+
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(offsetPath, []byte(strconv.FormatInt(offset, 10)), 0600)
+}
+
+// Flush the remaining records of a torn down tunnel and drop its charon log
+func closeAudit(s *tunnelState) error {
+	if err := flushAudit(s); err != nil {
+		return err
+	}
+	os.Remove(charonLogPath(s.ID))
+	os.Remove(charonLogPath(s.ID) + ".offset")
+	return nil
+}
+
+// audit command: flush the audit records of all tunnels, run it periodically
+// so records don't wait for the pods to be deleted
+func auditCommand(args []string) error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	states, err := loadTunnelStates()
+	if err != nil {
+		return err
+	}
+	for _, s := range states {
+		if err := flushAudit(s); err != nil {
+			return fmt.Errorf("failed to flush audit records of %s: %v", s.ContainerID, err)
+		}
+	}
+	return nil
+}
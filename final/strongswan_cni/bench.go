@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// bench command: measure the latency and throughput of a tunnel between two
+// namespaces with the given proposals, MTU and offload settings, so operators
+// can compare them on their hardware.
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	ike := flags.String("ike", "aes128gcm16-prfsha256-ecp256", "IKE proposal")
+	esp := flags.String("esp", "aes128gcm16-ecp256", "ESP proposal")
+	mtu := flags.Int("mtu", 1500, "MTU of the link between the namespaces")
+	offload := flags.String("hw-offload", "", "ESP hardware offload: yes, no or auto, charon's default when empty")
+	duration := flags.Duration("duration", 10*time.Second, "how long to measure throughput")
+	pings := flags.Int("pings", 20, "number of pings to measure latency")
+	iperf := flags.Bool("iperf3", false, "measure throughput with iperf3 instead of the built-in TCP test")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	respAddr := &net.IPNet{IP: net.ParseIP("10.254.1.1"), Mask: net.CIDRMask(30, 32)}
+	initAddr := &net.IPNet{IP: net.ParseIP("10.254.1.2"), Mask: net.CIDRMask(30, 32)}
+
+	respNS, err := createTestNetNS("bench-resp")
+	if err != nil {
+		return err
+	}
+	defer deleteTestNetNS("bench-resp", respNS)
+	initNS, err := createTestNetNS("bench-init")
+	if err != nil {
+		return err
+	}
+	defer deleteTestNetNS("bench-init", initNS)
+
+	if err := linkNetNSPair(respNS, initNS, respAddr, initAddr, *mtu); err != nil {
+		return err
+	}
+
+	secrets := "%any : PSK bench1234"
+	offloadOption := ""
+	if *offload != "" {
+		offloadOption = "\n\thw_offload=" + *offload
+	} else {
+		*offload = "default"
+	}
+	replacer := strings.NewReplacer("$IKE$", *ike, "$ESP$", *esp, "$Offload$", offloadOption)
+	for _, side := range []struct{ name, left, right string }{
+		{"bench-resp", respAddr.IP.String(), initAddr.IP.String()},
+		{"bench-init", initAddr.IP.String(), respAddr.IP.String()},
+	} {
+		conf := strings.NewReplacer("$Left$", side.left, "$Right$", side.right).Replace(replacer.Replace(benchConf))
+		if err := writeTestConfig(side.name, conf, secrets); err != nil {
+			return err
+		}
+		if out, err := exec.Command("ip", "netns", "exec", "ns-"+side.name, "ipsec", "start").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to start charon in %s: %v: %s", side.name, err, out)
+		}
+		defer exec.Command("ip", "netns", "exec", "ns-"+side.name, "ipsec", "stop").Run()
+	}
+
+	// Give both daemons a moment to load their config
+	time.Sleep(2 * time.Second)
+	start := time.Now()
+	if out, err := exec.Command("ip", "netns", "exec", "ns-bench-init", "ipsec", "up", "bench").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to establish the tunnel: %v: %s", err, out)
+	}
+	fmt.Printf("proposals:   ike=%s esp=%s\n", *ike, *esp)
+	fmt.Printf("mtu:         %d, hw offload: %s\n", *mtu, *offload)
+	fmt.Printf("handshake:   %v\n", time.Since(start).Round(time.Millisecond))
+
+	out, err := exec.Command("ip", "netns", "exec", "ns-bench-init", "ping", "-q", "-i", "0.2", "-c", fmt.Sprint(*pings), respAddr.IP.String()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ping failed: %v: %s", err, out)
+	}
+	if m := pingRttRegexp.FindStringSubmatch(string(out)); m != nil {
+		fmt.Printf("latency:     min %s / avg %s / max %s ms\n", m[1], m[2], m[3])
+	}
+
+	var bps float64
+	if *iperf {
+		bps, err = iperfThroughput(respAddr.IP, *duration)
+	} else {
+		bps, err = tcpThroughput(respNS, initNS, respAddr.IP, *duration)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("throughput:  %.1f Mbit/s\n", bps/1e6)
+	return nil
+}
+
+var pingRttRegexp = regexp.MustCompile(`= ([\d.]+)/([\d.]+)/([\d.]+)/`)
+
+// Link two namespaces with a veth pair
+func linkNetNSPair(a, b ns.NetNS, addrA, addrB *net.IPNet, mtu int) error {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "swan-bench0", MTU: mtu},
+		PeerName:  "swan-bench1",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create veth %q: %v", veth.Name, err)
+	}
+
+	for _, end := range []struct {
+		name  string
+		netns ns.NetNS
+		addr  *net.IPNet
+	}{{veth.Name, a, addrA}, {veth.PeerName, b, addrB}} {
+		link, err := netlink.LinkByName(end.name)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetNsFd(link, int(end.netns.Fd())); err != nil {
+			return err
+		}
+		addr := end.addr
+		err = end.netns.Do(func(_ ns.NetNS) error {
+			for _, name := range []string{"lo", end.name} {
+				link, err := netlink.LinkByName(name)
+				if err != nil {
+					return err
+				}
+				if err := netlink.LinkSetUp(link); err != nil {
+					return err
+				}
+			}
+			link, err := netlink.LinkByName(end.name)
+			if err != nil {
+				return err
+			}
+			return netlink.AddrAdd(link, &netlink.Addr{IPNet: addr})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Throughput with iperf3, which must be installed
+func iperfThroughput(server net.IP, duration time.Duration) (float64, error) {
+	srv := exec.Command("ip", "netns", "exec", "ns-bench-resp", "iperf3", "-s", "-1")
+	if err := srv.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start iperf3: %v", err)
+	}
+	defer srv.Wait()
+	time.Sleep(time.Second)
+
+	out, err := exec.Command("ip", "netns", "exec", "ns-bench-init", "iperf3", "-J", "-c", server.String(), "-t", fmt.Sprint(int(duration.Seconds()))).Output()
+	if err != nil {
+		srv.Process.Kill()
+		return 0, fmt.Errorf("iperf3 failed: %v", err)
+	}
+	var result struct {
+		End struct {
+			SumReceived struct {
+				BitsPerSecond float64 `json:"bits_per_second"`
+			} `json:"sum_received"`
+		} `json:"end"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return 0, err
+	}
+	return result.End.SumReceived.BitsPerSecond, nil
+}
+
+// Built-in throughput test: push zeros over a TCP connection through the
+// tunnel for duration. Sockets stay in the namespace they were created in.
+func tcpThroughput(serverNS, clientNS ns.NetNS, server net.IP, duration time.Duration) (float64, error) {
+	addr := net.JoinHostPort(server.String(), "5201")
+
+	var listener net.Listener
+	err := serverNS.Do(func(_ ns.NetNS) error {
+		var err error
+		listener, err = net.Listen("tcp", addr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	}()
+
+	var conn net.Conn
+	err = clientNS.Do(func(_ ns.NetNS) error {
+		var err error
+		conn, err = net.Dial("tcp", addr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 128*1024)
+	start := time.Now()
+	for time.Since(start) < duration {
+		if _, err := conn.Write(buf); err != nil {
+			conn.Close()
+			return 0, err
+		}
+	}
+	conn.Close()
+	n := <-received
+	return float64(n*8) / time.Since(start).Seconds(), nil
+}
+
+// The tunnel only covers the two addresses of the link
+const benchConf = `conn %default
+	keyexchange=ikev2
+	authby=secret
+
+conn bench
+	left=$Left$
+	leftsubnet=$Left$/32
+	right=$Right$
+	rightsubnet=$Right$/32
+	ike=$IKE$!
+	esp=$ESP$!
+	auto=add$Offload$`
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Without bridge, every network gets its own bridge named after a hash of
+// the network name, so several network configs using the plugin on one node
+// don't end up sharing a bridge, its addresses and its pods. The names fit
+// in the 15 characters of an interface name.
+const networkBridgePrefix = "cni-sw-"
+
+func networkBridgeName(network string) string {
+	sum := sha256.Sum256([]byte(network))
+	return networkBridgePrefix + hex.EncodeToString(sum[:4])
+}
+
+// The bridges of the networks of the node: those named by the plugin, and
+// those the tunnels of the pods were set up on. The caller holds the state
+// lock.
+func networkBridges(states []*tunnelState) ([]string, error) {
+	seen := map[string]bool{}
+	var bridges []string
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if link.Type() == "bridge" && strings.HasPrefix(link.Attrs().Name, networkBridgePrefix) {
+			seen[link.Attrs().Name] = true
+			bridges = append(bridges, link.Attrs().Name)
+		}
+	}
+	for _, s := range states {
+		if s.Bridge != "" && !seen[s.Bridge] {
+			seen[s.Bridge] = true
+			bridges = append(bridges, s.Bridge)
+		}
+	}
+	return bridges, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetworkBridgeName(t *testing.T) {
+	names := map[string]string{}
+	for _, network := range []string{"", "ipsec", "ipsec-2", "a-network-name-much-longer-than-an-interface-name"} {
+		name := networkBridgeName(network)
+		if len(name) > 15 {
+			t.Errorf("networkBridgeName(%q) = %q, longer than 15 characters", network, name)
+		}
+		if !strings.HasPrefix(name, networkBridgePrefix) {
+			t.Errorf("networkBridgeName(%q) = %q, without the %q prefix", network, name, networkBridgePrefix)
+		}
+		if again := networkBridgeName(network); again != name {
+			t.Errorf("networkBridgeName(%q) = %q, then %q", network, name, again)
+		}
+		if other, ok := names[name]; ok {
+			t.Errorf("networks %q and %q share bridge %q", other, network, name)
+		}
+		names[name] = network
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PKI plumbing for certificate authentication: a cluster root CA issues an
+// intermediate per node, which signs the pod certificates (see pki.go).
+//
+//	ca init        create the root CA
+//	ca issue       issue (or renew) the intermediate of a node
+//	ca bundle      print the trust bundle to install on the gateways
+//	ca controller  keep the intermediates of all nodes issued and published
+//	               as Secrets, run it next to the root CA
+//	ca sync        install the intermediate of this node from its Secret, run
+//	               it on every node
+const (
+	caNamespace    = "kube-system"
+	caSecretPrefix = "strongswan-node-ca-"
+
+	rootCALifetime = 10 * 365 * 24 * time.Hour
+	nodeCALifetime = 30 * 24 * time.Hour
+)
+
+func caCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ca init|issue|bundle|controller|sync [flags]")
+	}
+
+	flags := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	rootDir := flags.String("root-dir", "/etc/cni/strongswan/root", "directory of the root CA")
+	outDir := flags.String("out-dir", "/etc/cni/strongswan", "directory to write the node intermediate to")
+	node := flags.String("node", os.Getenv("NODE_NAME"), "name of the node")
+	renewBefore := flags.Duration("renew-before", 10*24*time.Hour, "renew intermediates expiring within this duration")
+	interval := flags.Duration("interval", time.Hour, "how often controller and sync run")
+	kubeconfig := flags.String("kubeconfig", "", "kubeconfig used to reach the API server")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	kubectl := func(args ...string) *exec.Cmd {
+		if *kubeconfig != "" {
+			args = append([]string{"--kubeconfig", *kubeconfig}, args...)
+		}
+		return exec.Command("kubectl", args...)
+	}
+
+	switch args[0] {
+	case "init":
+		return initRootCA(*rootDir)
+	case "issue":
+		if *node == "" {
+			return fmt.Errorf("-node is required")
+		}
+		_, err := ensureNodeCA(*rootDir, *outDir, *node, *renewBefore)
+		return err
+	case "bundle":
+		data, err := ioutil.ReadFile(filepath.Join(*rootDir, "root.crt"))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case "controller":
+		return every(*interval, func() error {
+			return publishNodeCAs(kubectl, *rootDir, *renewBefore)
+		})
+	case "sync":
+		if *node == "" {
+			return fmt.Errorf("-node is required")
+		}
+		return every(*interval, func() error {
+			return installNodeCA(kubectl, *node, *outDir)
+		})
+	}
+	return fmt.Errorf("unknown ca command %q", args[0])
+}
+
+// Run fn now and then every interval, failures are retried on the next run
+func every(interval time.Duration, fn func() error) error {
+	for {
+		if err := fn(); err != nil {
+			log.Println(logPrefix, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Create the self-signed root CA, unless there is one already
+func initRootCA(rootDir string) error {
+	certPath := filepath.Join(rootDir, "root.crt")
+	if _, err := os.Stat(certPath); err == nil {
+		log.Println(logPrefix, "root CA already exists in", rootDir)
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "strongswan-cni root CA"},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(rootCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certPEM, err := signCert(template, nil, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(rootDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootDir, "root.key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, certPEM, 0644)
+}
+
+// Issue the intermediate of node into outDir unless a valid one is there
+// already. It returns whether a new intermediate was issued.
+func ensureNodeCA(rootDir, outDir, node string, renewBefore time.Duration) (bool, error) {
+	if cert, err := loadCert(filepath.Join(outDir, "node-ca.crt")); err == nil {
+		if time.Now().Add(renewBefore).Before(cert.NotAfter) {
+			return false, nil
+		}
+		log.Println(logPrefix, "renewing intermediate CA of", node, "expiring on", cert.NotAfter)
+	}
+
+	rootCert, err := loadCert(filepath.Join(rootDir, "root.crt"))
+	if err != nil {
+		return false, err
+	}
+	rootKey, err := loadKey(filepath.Join(rootDir, "root.key"))
+	if err != nil {
+		return false, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	// Node intermediates may only sign pod certificates
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "strongswan-cni node " + node},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(nodeCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certPEM, err := signCert(template, rootCert, key.Public(), rootKey)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return false, err
+	}
+	rootPEM, err := ioutil.ReadFile(filepath.Join(rootDir, "root.crt"))
+	if err != nil {
+		return false, err
+	}
+
+	return true, writeNodeCA(outDir, map[string][]byte{
+		"node-ca.key": keyPEM,
+		"node-ca.crt": certPEM,
+		"ca.crt":      rootPEM,
+	})
+}
+
+// Write the files of a node intermediate, each replaced atomically. ADD may
+// read them in between, with the key of one intermediate and the
+// certificate of the other, and reads them again then, see loadNodeCA.
+func writeNodeCA(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, name := range []string{"node-ca.key", "node-ca.crt", "ca.crt"} {
+		perm := os.FileMode(0644)
+		if name == "node-ca.key" {
+			perm = 0600
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path+".tmp", files[name], perm); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Issue or renew the intermediates of all nodes and publish them as Secrets
+func publishNodeCAs(kubectl func(args ...string) *exec.Cmd, rootDir string, renewBefore time.Duration) error {
+	out, err := kubectl("get", "nodes", "-o", "jsonpath={.items[*].metadata.name}").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	for _, node := range strings.Fields(string(out)) {
+		dir := filepath.Join(rootDir, "nodes", node)
+		issued, err := ensureNodeCA(rootDir, dir, node, renewBefore)
+		if err != nil {
+			return err
+		}
+
+		// Applied even when nothing was issued, so a Secret which was deleted,
+		// or not published after a failure, is put back. Applying an unchanged
+		// one is a no-op.
+		args := []string{"create", "secret", "generic", caSecretPrefix + node, "--namespace", caNamespace, "--dry-run=client", "-o", "json"}
+		for _, name := range []string{"node-ca.key", "node-ca.crt", "ca.crt"} {
+			args = append(args, "--from-file="+name+"="+filepath.Join(dir, name))
+		}
+		secret, err := kubectl(args...).Output()
+		if err != nil {
+			return fmt.Errorf("failed to generate secret of %q: %v", node, err)
+		}
+		apply := kubectl("apply", "-f", "-")
+		apply.Stdin = bytes.NewReader(secret)
+		if out, err := apply.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to publish secret of %q: %v: %s", node, err, out)
+		}
+		if issued {
+			log.Println(logPrefix, "published intermediate CA of", node)
+		}
+	}
+	return nil
+}
+
+// Install the intermediate of node from its Secret when it changed
+func installNodeCA(kubectl func(args ...string) *exec.Cmd, node, outDir string) error {
+	out, err := kubectl("get", "secret", caSecretPrefix+node, "--namespace", caNamespace, "-o", "json").Output()
+	if err != nil {
+		return fmt.Errorf("failed to get secret of %q: %v", node, err)
+	}
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(out, &secret); err != nil {
+		return err
+	}
+
+	files := map[string][]byte{}
+	changed := false
+	for _, name := range []string{"node-ca.key", "node-ca.crt", "ca.crt"} {
+		data, err := base64.StdEncoding.DecodeString(secret.Data[name])
+		if err != nil || len(data) == 0 {
+			return fmt.Errorf("secret of %q has no valid %s", node, name)
+		}
+		files[name] = data
+		if current, err := ioutil.ReadFile(filepath.Join(outDir, name)); err != nil || !bytes.Equal(current, data) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Println(logPrefix, "installing intermediate CA of", node)
+	return writeNodeCA(outDir, files)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With charonCPU or charonMemory, charon of each pod runs in a cgroup v2 with
+// those limits, so a misbehaving one can't starve the node. The cgroup is
+// created under the one of the pod when it can be found, so the usage of
+// charon is accounted to the pod and counts against its own limits too,
+// else under strongswan-cni at the root. The bringup script moves itself
+// into it before starting charon, which inherits it.
+const (
+	cgroupRoot        = "/sys/fs/cgroup"
+	charonCgroupName  = "strongswan-charon"
+	fallbackCgroupDir = "strongswan-cni"
+	cpuPeriod         = 100000
+)
+
+type charonLimits struct {
+	// Empty when systemd runs charon
+	Cgroup string `json:"cgroup,omitempty"`
+	// cpu.max quota for cpuPeriod, 0 for no limit
+	CPUQuota int64 `json:"cpuQuota,omitempty"`
+	// memory.max, 0 for no limit
+	Memory int64 `json:"memory,omitempty"`
+}
+
+func validateCharonLimits(n *NetConf) error {
+	if n.CharonCPU == "" && n.CharonMemory == "" {
+		return nil
+	}
+	if _, err := parseCPU(n.CharonCPU); err != nil {
+		return err
+	}
+	if _, err := parseMemory(n.CharonMemory); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("charonCPU and charonMemory need cgroup v2 mounted on %s", cgroupRoot)
+	}
+	return nil
+}
+
+// CPU in cores, eg: 0.5, or in millicores, eg: 500m, like Kubernetes
+// resources, as a cpu.max quota
+func parseCPU(cpu string) (int64, error) {
+	if cpu == "" {
+		return 0, nil
+	}
+	cores, err := strconv.ParseFloat(strings.TrimSuffix(cpu, "m"), 64)
+	if strings.HasSuffix(cpu, "m") {
+		cores /= 1000
+	}
+	quota := int64(math.Ceil(cores * cpuPeriod))
+	// The kernel refuses quotas under 1ms
+	if err != nil || quota < 1000 {
+		return 0, fmt.Errorf("invalid charonCPU %q: expected cores, eg: 0.5, or millicores, eg: 500m, of at least 10m", cpu)
+	}
+	return quota, nil
+}
+
+// Memory in bytes, with an optional K, M, G or Ki, Mi, Gi suffix
+func parseMemory(memory string) (int64, error) {
+	if memory == "" {
+		return 0, nil
+	}
+	value, unit := memory, int64(1)
+	for _, suffix := range []struct {
+		suffix string
+		unit   int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9},
+	} {
+		if strings.HasSuffix(memory, suffix.suffix) {
+			value, unit = strings.TrimSuffix(memory, suffix.suffix), suffix.unit
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	// charon alone needs a few MB
+	if err != nil || n*unit < 16<<20 {
+		return 0, fmt.Errorf("invalid charonMemory %q: expected bytes with an optional K, M, G, Ki, Mi or Gi suffix, of at least 16Mi", memory)
+	}
+	return n * unit, nil
+}
+
+// The limits of the charon of a new pod, nil without any
+func newCharonLimits(n *NetConf, s *tunnelState, podUID string) *charonLimits {
+	if n.CharonCPU == "" && n.CharonMemory == "" {
+		return nil
+	}
+	// Validated when the config was loaded
+	cpuQuota, _ := parseCPU(n.CharonCPU)
+	memory, _ := parseMemory(n.CharonMemory)
+	if n.Systemd {
+		// Set on the unit
+		return &charonLimits{CPUQuota: cpuQuota, Memory: memory}
+	}
+
+	cgroup := filepath.Join(cgroupRoot, fallbackCgroupDir, s.ID)
+	if pod := podCgroup(s.NetNS, podUID); pod != "" {
+		cgroup = filepath.Join(pod, charonCgroupName)
+	}
+	return &charonLimits{Cgroup: cgroup, CPUQuota: cpuQuota, Memory: memory}
+}
+
+// The cgroup of the pod: the parent of the one of its sandbox process when
+// the namespace is given by pid, else the one named after its UID in the
+// kubepods hierarchy, with the cgroupfs or the systemd driver. Empty when
+// not found.
+func podCgroup(netNs, podUID string) string {
+	if part := strings.Split(netNs, "/"); len(part) > 2 && part[1] == "proc" {
+		if cgroup := processCgroup(part[2]); cgroup != "" && cgroup != "/" {
+			return filepath.Join(cgroupRoot, filepath.Dir(cgroup))
+		}
+	}
+	if podUID == "" {
+		return ""
+	}
+
+	// pod<uid> with cgroupfs, kubepods-<qos>-pod<uid with _>.slice with
+	// systemd
+	cgroupfsName := "pod" + podUID
+	systemdSuffix := "-pod" + strings.Replace(podUID, "-", "_", -1) + ".slice"
+
+	// kubepods[.slice]/[<qos>/]<pod>
+	var walk func(dir string, depth int) string
+	walk = func(dir string, depth int) string {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil || depth > 3 {
+			return ""
+		}
+		for _, e := range entries {
+			if !e.IsDir() || !strings.HasPrefix(e.Name(), "kubepods") && !strings.HasPrefix(e.Name(), "pod") {
+				continue
+			}
+			if e.Name() == cgroupfsName || strings.HasSuffix(e.Name(), systemdSuffix) {
+				return filepath.Join(dir, e.Name())
+			}
+			if found := walk(filepath.Join(dir, e.Name()), depth+1); found != "" {
+				return found
+			}
+		}
+		return ""
+	}
+	return walk(cgroupRoot, 1)
+}
+
+// The cgroup v2 path of a process
+func processCgroup(pid string) string {
+	f, err := os.Open(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::")
+		}
+	}
+	return ""
+}
+
+// Create the cgroup of the charon of the pod with its limits, again when it
+// already exists
+func setupCharonCgroup(s *tunnelState) error {
+	l := s.CharonLimits
+	if l == nil || l.Cgroup == "" {
+		return nil
+	}
+	parent := filepath.Dir(l.Cgroup)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %q: %v", parent, err)
+	}
+	// Controllers are only available to a cgroup once every ancestor
+	// enables them for its children, from the root down
+	rel, err := filepath.Rel(cgroupRoot, parent)
+	if err != nil {
+		return err
+	}
+	dir := cgroupRoot
+	for _, elem := range append([]string{""}, strings.Split(rel, "/")...) {
+		if elem == "." {
+			continue
+		}
+		dir = filepath.Join(dir, elem)
+		if err := enableControllers(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(l.Cgroup, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create cgroup %q: %v", l.Cgroup, err)
+	}
+
+	cpuMax, memoryMax := "max", "max"
+	if l.CPUQuota > 0 {
+		cpuMax = fmt.Sprintf("%d %d", l.CPUQuota, cpuPeriod)
+	}
+	if l.Memory > 0 {
+		memoryMax = strconv.FormatInt(l.Memory, 10)
+	}
+	for file, value := range map[string]string{"cpu.max": cpuMax, "memory.max": memoryMax} {
+		if err := ioutil.WriteFile(filepath.Join(l.Cgroup, file), []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s of %q: %v", file, l.Cgroup, err)
+		}
+	}
+	return nil
+}
+
+func enableControllers(dir string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644); err != nil {
+		return fmt.Errorf("failed to enable the cpu and memory controllers in %q: %v", dir, err)
+	}
+	return nil
+}
+
+// Remove the cgroup of the charon of the pod once charon stopped, killing
+// what's left in it, eg: the bringup script still waiting for the pod
+func removeCharonCgroup(s *tunnelState) error {
+	l := s.CharonLimits
+	if l == nil || l.Cgroup == "" {
+		return nil
+	}
+	// cgroup.kill needs Linux 5.14, it's fine for it to be missing
+	ioutil.WriteFile(filepath.Join(l.Cgroup, "cgroup.kill"), []byte("1"), 0644)
+
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(l.Cgroup); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup %q: %v", l.Cgroup, err)
+}
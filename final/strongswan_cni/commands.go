@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// Besides being a CNI plugin, which the runtime always invokes without
+// arguments, the binary carries operator commands: strongswan <command> ...
+var commands = map[string]func(args []string) error{
+	"audit":     auditCommand,
+	"bench":     benchCommand,
+	"ca":        caCommand,
+	"daemon":    daemonCommand,
+	"drain":     drainCommand,
+	"gc":        gcCommand,
+	"nsexec":    nsexecCommand,
+	"responder": responderCommand,
+	"undrain":   undrainCommand,
+	"update":    updateCommand,
+	"updown":    updownCommand,
+}
+
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "unknown command %q, available commands: %v\n", name, names)
+		return 2
+	}
+
+	if err := validateRootlessDir(); err != nil {
+		log.Println(logPrefix, name, "failed:", err)
+		return 1
+	}
+	if err := cmd(args); err != nil {
+		log.Println(logPrefix, name, "failed:", err)
+		return 1
+	}
+	return 0
+}
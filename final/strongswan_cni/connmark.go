@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// With connmark, every CHILD_SA of a pod gets a unique outbound mark, so
+// peers advertising overlapping subnets each get their own SA instead of
+// fighting over the same policies. Traffic only matches the outbound policy
+// of an SA once it carries its mark, which the updown command sets up in the
+// mangle table of the pod. New connections to the remote subnet of an SA get
+// the mark of the first SA covering them, connections the peer of an SA
+// initiates get the mark of that SA. The mark is saved on the connection and
+// restored on every packet, so replies leave through the SA the connection
+// came in or first went out through. charon also loads its connmark plugin,
+// which does the same for transport mode SAs.
+const charonConnmark = `
+	plugins {
+		connmark {
+			load = yes
+		}
+	}`
+
+func validateConnmark(vpnInfo vpnInfo) error {
+	// Trap policies would be marked too, unmarked traffic would leave in
+	// plaintext while the tunnel is down
+	if vpnInfo.Connmark && vpnInfo.Inactivity != "" {
+		return fmt.Errorf("connmark can't be used with inactivity")
+	}
+	// The SA marks take the whole packet mark. dscp copy sets its bits
+	// before the connmark rules, so new connections wouldn't look unmarked
+	// and restored marks wouldn't equal the SA ones, both leaving in
+	// plaintext, and the marks of markMask would collide the same way.
+	if copy, _, _ := parseDSCP(vpnInfo.DSCP); vpnInfo.Connmark && copy {
+		return fmt.Errorf("connmark can't be used with dscp copy")
+	}
+	if vpnInfo.Connmark && vpnInfo.MarkMask != "" {
+		return fmt.Errorf("connmark can't be used with markMask")
+	}
+	return nil
+}
+
+// Rules of a CHILD_SA, by chain of the mangle table
+func connmarkRules(reqid, peerClient, mark string) map[string][][]string {
+	unmarked := "0/" + strings.SplitN(mark, "/", 2)[1]
+	comment := []string{"-m", "comment", "--comment", "strongswan-cni reqid " + reqid}
+	return map[string][][]string{
+		"OUTPUT": {
+			append([]string{"-d", peerClient, "-m", "mark", "--mark", unmarked, "-j", "MARK", "--set-xmark", mark}, comment...),
+			append([]string{"-d", peerClient, "-m", "mark", "--mark", mark, "-j", "CONNMARK", "--save-mark"}, comment...),
+		},
+		"PREROUTING": {
+			append([]string{"-m", "policy", "--dir", "in", "--pol", "ipsec", "--reqid", reqid,
+				"-m", "conntrack", "--ctstate", "NEW", "-j", "CONNMARK", "--set-xmark", mark}, comment...),
+		},
+	}
+}
+
+// Add the rules of the CHILD_SA going up, remove those of the one going
+// down. Runs in the pod namespace from the updown command.
+func updateConnmark(verb string) error {
+	up := strings.HasPrefix(verb, "up-client")
+	if !up && !strings.HasPrefix(verb, "down-client") {
+		return nil
+	}
+	mark := os.Getenv("PLUTO_MARK_OUT")
+	if !strings.Contains(mark, "/") {
+		return fmt.Errorf("invalid PLUTO_MARK_OUT %q", mark)
+	}
+
+	peerClient := os.Getenv("PLUTO_PEER_CLIENT")
+	proto := iptables.ProtocolIPv4
+	if ip, _, err := net.ParseCIDR(peerClient); err == nil && ip.To4() == nil {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return err
+	}
+
+	restore := []string{"-j", "CONNMARK", "--restore-mark"}
+	if up {
+		exists, err := ipt.Exists("mangle", "OUTPUT", restore...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := ipt.Insert("mangle", "OUTPUT", 1, restore...); err != nil {
+				return err
+			}
+		}
+	}
+
+	for chain, rules := range connmarkRules(os.Getenv("PLUTO_REQID"), peerClient, mark) {
+		for _, rule := range rules {
+			if up {
+				err = ipt.AppendUnique("mangle", chain, rule...)
+			} else if exists, _ := ipt.Exists("mangle", chain, rule...); exists {
+				err = ipt.Delete("mangle", chain, rule...)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to update connmark rules: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// daemon command: a long running companion of the plugin on each node,
+// eg: in a DaemonSet. It serves the metrics, live ones included, in the
+// Prometheus format on /metrics, the tunnels of the node as JSON on
+// /status and the SAs of one of them on /tunnel. It also starts the tunnels
+// queued by ADD, brings back the tunnels whose charon stopped, when it
+// starts and then periodically, renews the certificates of the pods, applies
+// policyPriority again, adds back the firewalld rules after reloads, cleans up what failed DELs left
+// behind, and may alert a webhook when tunnels go down.
+func daemonCommand(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:9731", "address to serve /metrics, /status and /tunnel on")
+	restore := flags.Bool("restore", true, "restore the tunnels of running pods whose charon isn't running")
+	restoreInterval := flags.Duration("restore-interval", time.Minute, "how often to look for tunnels to restore, 0 to only do it on start")
+	queue := flags.Bool("queue", true, "start the tunnels queued by ADD with establishQueue")
+	queueParallel := flags.Int("queue-parallel", 4, "number of queued tunnels started at the same time")
+	queueRate := flags.Float64("queue-rate", 2, "queued tunnels started per second")
+	gcInterval := flags.Duration("gc-interval", 10*time.Minute, "how often to clean up what failed DELs left behind, 0 to never do it")
+	gcBridge := flags.String("gc-bridge", "", "bridge of the pods, whose orphaned veths are cleaned up, those of every network by default")
+	gcPodCIDRs := flags.String("gc-pod-cidr", "", "comma separated subnets of the pods, whose stale xfrm states and policies are cleaned up")
+	webhook := flags.String("webhook", "", "URL to POST tunnel down and failure events to")
+	webhookInterval := flags.Duration("webhook-interval", 30*time.Second, "how often to check the tunnels for the webhook")
+	webhookFailures := flags.Int("webhook-failures", 3, "checks in a row a tunnel must fail to come up before it's reported")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *queue && (*queueParallel < 1 || *queueRate <= 0) {
+		return fmt.Errorf("-queue-parallel must be at least 1 and -queue-rate positive")
+	}
+	if *webhook != "" && (*webhookInterval <= 0 || *webhookFailures < 1) {
+		return fmt.Errorf("-webhook-interval must be positive and -webhook-failures at least 1")
+	}
+
+	if *restore {
+		go func() {
+			restoreTunnels()
+			if *restoreInterval <= 0 {
+				return
+			}
+			for range time.Tick(*restoreInterval) {
+				restoreTunnels()
+			}
+		}()
+	}
+
+	go func() {
+		renewPodCerts()
+		for range time.Tick(certRenewInterval) {
+			renewPodCerts()
+		}
+	}()
+
+	go watchFirewalldReloads()
+
+	go func() {
+		for range time.Tick(policyPriorityInterval) {
+			reapplyPolicyPriorities()
+		}
+	}()
+
+	if *queue {
+		go serveQueue(*queueParallel, *queueRate)
+	}
+
+	cidrs, err := parsePodCIDRs(*gcPodCIDRs)
+	if err != nil {
+		return err
+	}
+	gc := gcOptions{bridge: *gcBridge, podCIDRs: cidrs}
+	if *gcInterval > 0 {
+		go func() {
+			for range time.Tick(*gcInterval) {
+				if err := collectGarbage(gc); err != nil {
+					log.Println(logPrefix, "failed to clean up:", err)
+				}
+			}
+		}()
+	}
+
+	if *webhook != "" {
+		go func() {
+			w := newTunnelWatcher(*webhook, *webhookFailures)
+			for range time.Tick(*webhookInterval) {
+				w.check()
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/tunnel", serveTunnel)
+
+	log.Println(logPrefix, "daemon listening on", *listen)
+	return http.ListenAndServe(*listen, mux)
+}
+
+// What /status reports about a tunnel. The VPN config holds secrets, so it
+// isn't part of it.
+type tunnelStatus struct {
+	ID          string       `json:"id"`
+	ContainerID string       `json:"containerID"`
+	Namespace   string       `json:"namespace,omitempty"`
+	Pod         string       `json:"pod,omitempty"`
+	Network     string       `json:"network"`
+	ServerIP    string       `json:"serverIP"`
+	IPs         []net.IP     `json:"ips,omitempty"`
+	Mark        uint32       `json:"mark,omitempty"`
+	Zone        uint16       `json:"zone,omitempty"`
+	Created     time.Time    `json:"created"`
+	Handshake   float64      `json:"handshakeSeconds,omitempty"`
+	Traffic     *podTraffic  `json:"traffic,omitempty"`
+	Datapath    *podDatapath `json:"datapath,omitempty"`
+}
+
+func loadStatus() ([]*tunnelStatus, *metrics, error) {
+	unlock, err := lockState()
+	if err != nil {
+		return nil, nil, err
+	}
+	states, err := loadTunnelStates()
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	m, err := loadMetrics()
+	unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	traffic, err := readAccounting()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	status := make([]*tunnelStatus, 0, len(states))
+	for _, s := range states {
+		datapath, err := readBPFStats(s)
+		if err != nil {
+			log.Println(logPrefix, "failed to read eBPF stats of", s.ContainerID+":", err)
+		}
+		status = append(status, &tunnelStatus{
+			ID:          s.ID,
+			ContainerID: s.ContainerID,
+			Namespace:   s.Namespace,
+			Pod:         s.Pod,
+			Network:     s.Network,
+			ServerIP:    s.VPN.ServerIP,
+			IPs:         s.IPs,
+			Mark:        s.Mark,
+			Zone:        s.Zone,
+			Created:     s.Created,
+			Handshake:   s.HandshakeSeconds,
+			Traffic:     traffic[s.ID],
+			Datapath:    datapath,
+		})
+	}
+	return status, m, nil
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	status, _, err := loadStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	status, m, err := loadStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.Gauges["strongswan_cni_establish_queue_length"] = float64(len(queuedTunnels()))
+	for _, s := range status {
+		labels := fmt.Sprintf(`id=%q,container_id=%q,namespace=%q,pod=%q`, s.ID, s.ContainerID, s.Namespace, s.Pod)
+		if s.Handshake > 0 {
+			m.Gauges[fmt.Sprintf(`strongswan_cni_pod_ike_handshake_seconds{%s}`, labels)] = s.Handshake
+		}
+		if s.Datapath != nil {
+			for dir, direction := range []string{"tx", "rx"} {
+				for class, c := range map[string]bpfCounter{"tunneled": s.Datapath.Tunneled[dir], "plaintext": s.Datapath.Plaintext[dir]} {
+					m.Counters[fmt.Sprintf(`strongswan_cni_pod_datapath_bytes_total{%s,direction=%q,class=%q}`, labels, direction, class)] = float64(c.Bytes)
+					m.Counters[fmt.Sprintf(`strongswan_cni_pod_datapath_packets_total{%s,direction=%q,class=%q}`, labels, direction, class)] = float64(c.Packets)
+				}
+			}
+			m.Counters[fmt.Sprintf(`strongswan_cni_pod_dropped_packets_total{%s,direction="tx"}`, labels)] = float64(s.Datapath.TxDropped)
+			m.Counters[fmt.Sprintf(`strongswan_cni_pod_dropped_packets_total{%s,direction="rx"}`, labels)] = float64(s.Datapath.RxDropped)
+		}
+
+		if s.Traffic == nil {
+			continue
+		}
+		m.Counters[fmt.Sprintf(`strongswan_cni_pod_bytes_total{%s,direction="tx"}`, labels)] = float64(s.Traffic.TxBytes)
+		m.Counters[fmt.Sprintf(`strongswan_cni_pod_bytes_total{%s,direction="rx"}`, labels)] = float64(s.Traffic.RxBytes)
+		m.Counters[fmt.Sprintf(`strongswan_cni_pod_packets_total{%s,direction="tx"}`, labels)] = float64(s.Traffic.TxPackets)
+		m.Counters[fmt.Sprintf(`strongswan_cni_pod_packets_total{%s,direction="rx"}`, labels)] = float64(s.Traffic.RxPackets)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(m.render())
+}
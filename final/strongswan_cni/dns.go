@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const dnsChain = "STRONGSWAN-DNS"
+
+// DNS ports: plain DNS, DNS over TLS and over QUIC
+var dnsMatches = []string{"-p udp --dport 53", "-p tcp --dport 53", "-p tcp --dport 853", "-p udp --dport 853"}
+
+// Keep the DNS traffic of the pod from leaking out of the tunnel: DNS
+// packets which don't go through an IPsec policy are dropped. Queries to
+// port 53 are also sent through the nat chain which the updown command
+// fills with a DNAT to the resolvers the gateway hands out, so pods keep
+// resolving with their usual resolv.conf.
+func setupForcedDNS(netns ns.NetNS, vpnInfo vpnInfo) error {
+	if !vpnInfo.ForceDNS {
+		return nil
+	}
+
+	rules := forcedDNSRules()
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, restore := range []string{"iptables-restore", "ip6tables-restore"} {
+			cmd := exec.Command(restore, "--noflush")
+			cmd.Stdin = strings.NewReader(rules)
+			var out bytes.Buffer
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("failed to install dns rules: %v: %s", err, out.String())
+			}
+		}
+		return nil
+	})
+}
+
+// Generate the filter and nat tables for iptables-restore
+func forcedDNSRules() string {
+	var b bytes.Buffer
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", dnsChain)
+	fmt.Fprintf(&b, "-A %s -m policy --dir out --pol ipsec -j RETURN\n", dnsChain)
+	fmt.Fprintf(&b, "-A %s -j DROP\n", dnsChain)
+	for _, match := range dnsMatches {
+		fmt.Fprintf(&b, "-A OUTPUT %s -j %s\n", match, dnsChain)
+	}
+	b.WriteString("COMMIT\n")
+
+	b.WriteString("*nat\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", dnsChain)
+	for _, match := range dnsMatches[:2] {
+		fmt.Fprintf(&b, "-A OUTPUT %s -j %s\n", match, dnsChain)
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// Called by the updown command: point port 53 to the first resolver of each
+// family the gateway handed out when the CHILD_SA comes up, and stop
+// redirecting when it goes down
+func updateForcedDNS(verb string) error {
+	up := strings.HasPrefix(verb, "up-client")
+	if !up && !strings.HasPrefix(verb, "down-client") {
+		return nil
+	}
+
+	for _, family := range []struct {
+		proto iptables.Protocol
+		env   string
+	}{{iptables.ProtocolIPv4, "PLUTO_DNS4_1"}, {iptables.ProtocolIPv6, "PLUTO_DNS6_1"}} {
+		ipt, err := iptables.NewWithProtocol(family.proto)
+		if err != nil {
+			return err
+		}
+		if err := ipt.ClearChain("nat", dnsChain); err != nil {
+			return err
+		}
+
+		server := net.ParseIP(os.Getenv(family.env))
+		if !up || server == nil {
+			continue
+		}
+		to := server.String()
+		if family.proto == iptables.ProtocolIPv6 {
+			to = "[" + to + "]"
+		}
+		for _, proto := range []string{"udp", "tcp"} {
+			if err := ipt.Append("nat", dnsChain, "-p", proto, "-j", "DNAT", "--to-destination", to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// charon must not rewrite resolv.conf: it runs in the pod namespace but sees
+// the /etc of the host
+const charonNoResolve = `
+	plugins {
+		resolve {
+			load = no
+		}
+	}`
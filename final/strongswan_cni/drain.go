@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// drain command: close the tunnels of every pod of the node before
+// maintenance. Each connection is closed with ipsec down, so charon sends
+// DELETE payloads and the gateway doesn't hold half-open SAs until DPD gives
+// up on them, then charon is stopped so nothing renegotiates. Routed
+// connections are unrouted first, else new traffic would bring them back.
+// Pods and their state are left alone; they're deleted as they're evicted.
+// The states are marked drained so neither the daemon nor a repeated ADD
+// start charon again, until undrain.
+func drainCommand(args []string) error {
+	flags := flag.NewFlagSet("drain", flag.ContinueOnError)
+	parallel := flags.Int("parallel", 8, "number of tunnels closed at the same time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("invalid -parallel %d: must be at least 1", *parallel)
+	}
+
+	states, err := setDrained(true)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(states))
+	slots := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	for i, s := range states {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, s *tunnelState) {
+			defer wg.Done()
+			errs[i] = drainTunnel(s)
+			<-slots
+		}(i, s)
+	}
+	wg.Wait()
+
+	log.Println(logPrefix, "drained", len(states), "tunnels")
+	return joinErrors(errs)
+}
+
+// undrain command: let the daemon restore the tunnels of the pods again
+func undrainCommand(args []string) error {
+	states, err := setDrained(false)
+	if err != nil {
+		return err
+	}
+	log.Println(logPrefix, "undrained", len(states), "tunnels")
+	return nil
+}
+
+// Mark every tunnel state as drained or not, under the state lock
+func setDrained(drained bool) ([]*tunnelState, error) {
+	unlock, err := lockState()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	states, err := loadTunnelStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if s.Drained == drained {
+			continue
+		}
+		s.Drained = drained
+		if err := saveTunnelState(s); err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+func drainTunnel(s *tunnelState) error {
+	dequeueTunnel(s.ID)
+	for _, c := range vpnConns(s.VPN) {
+		if connAuto(s.VPN) == "route" {
+			netnsCommand(s.ID, "ipsec", "unroute", c.name).Run()
+		}
+		// Fails when the connection isn't up, eg: the IKEv1 one with
+		// fallback
+		netnsCommand(s.ID, "ipsec", "down", c.name).Run()
+	}
+	if out, err := netnsCommand(s.ID, "ipsec", "stop").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to stop charon of %s: %v: %s", s.ContainerID, err, out)
+	}
+	return nil
+}
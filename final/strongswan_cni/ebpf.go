@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// With ebpfStats, a tc program on both sides of the host veth of each pod
+// counts its packets and bytes, split between tunneled, ie: ESP and IKE, and
+// plaintext IP traffic. It's far cheaper than iptables counters and sees
+// everything the pod sends, whatever the firewall does with it. The counters
+// live in a per-CPU map pinned in bpfStatsDir for the daemon to read; packets
+// dropped on the veth come from its link statistics.
+const bpfStatsDir = "/sys/fs/bpf/strongswan-cni"
+
+// Keys of the counters map: direction*2 + class
+const (
+	bpfClassTunneled  = 0
+	bpfClassPlaintext = 1
+
+	bpfDirTx = 0 // from the pod, ingress of the host veth
+	bpfDirRx = 1 // to the pod, egress of the host veth
+)
+
+type bpfCounter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+func bpfStatsPath(id string) string {
+	return filepath.Join(bpfStatsDir, id)
+}
+
+// Classifier counting the packets of one direction into counters. Packets
+// always go on, the program returns TC_ACT_UNSPEC.
+func bpfStatsProgram(counters *ebpf.Map, dir int32) asm.Instructions {
+	loadBytes := func(offset asm.Register, size int32, fail string) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Reg(asm.R1, asm.R6),
+			asm.Mov.Reg(asm.R2, offset),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, -8),
+			asm.Mov.Imm(asm.R4, size),
+			asm.FnSkbLoadBytes.Call(),
+			asm.JNE.Imm(asm.R0, 0, fail),
+		}
+	}
+	isIKEPort := func(off int16) asm.Instructions {
+		return asm.Instructions{
+			asm.LoadMem(asm.R2, asm.RFP, off, asm.Half),
+			asm.JEq.Imm(asm.R2, int32(htons(4500)), "tunneled"),
+			asm.JEq.Imm(asm.R2, int32(htons(500)), "tunneled"),
+		}
+	}
+
+	var insns asm.Instructions
+	insns = append(insns,
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.Mov.Imm(asm.R7, bpfClassPlaintext),
+		// skb->protocol, in network byte order
+		asm.LoadMem(asm.R2, asm.R6, 16, asm.Word),
+		asm.JEq.Imm(asm.R2, int32(htons(unix.ETH_P_IP)), "ipv4"),
+		asm.JEq.Imm(asm.R2, int32(htons(unix.ETH_P_IPV6)), "ipv6"),
+		asm.Ja.Label("exit"),
+
+		// IPv4: the L4 offset depends on the header length
+		asm.Mov.Imm(asm.R8, 14).WithSymbol("ipv4"),
+	)
+	insns = append(insns, loadBytes(asm.R8, 1, "exit")...)
+	insns = append(insns,
+		asm.LoadMem(asm.R9, asm.RFP, -8, asm.Byte),
+		asm.And.Imm(asm.R9, 0x0f),
+		asm.LSh.Imm(asm.R9, 2),
+		asm.Add.Imm(asm.R9, 14),
+		asm.Mov.Imm(asm.R8, 14+9),
+	)
+	insns = append(insns, loadBytes(asm.R8, 1, "exit")...)
+	insns = append(insns,
+		asm.Ja.Label("l4"),
+
+		// IPv6, extension headers aren't followed
+		asm.Mov.Imm(asm.R9, 14+40).WithSymbol("ipv6"),
+		asm.Mov.Imm(asm.R8, 14+6),
+	)
+	insns = append(insns, loadBytes(asm.R8, 1, "exit")...)
+	insns = append(insns,
+		asm.LoadMem(asm.R2, asm.RFP, -8, asm.Byte).WithSymbol("l4"),
+		asm.JEq.Imm(asm.R2, unix.IPPROTO_ESP, "tunneled"),
+		asm.JNE.Imm(asm.R2, unix.IPPROTO_UDP, "count"),
+	)
+	insns = append(insns, loadBytes(asm.R9, 4, "count")...)
+	insns = append(insns, isIKEPort(-8)...)
+	insns = append(insns, isIKEPort(-6)...)
+	insns = append(insns,
+		asm.Ja.Label("count"),
+
+		asm.Mov.Imm(asm.R7, bpfClassTunneled).WithSymbol("tunneled"),
+
+		// Per-CPU values, no need for atomic operations
+		asm.Add.Imm(asm.R7, dir*2).WithSymbol("count"),
+		asm.StoreMem(asm.RFP, -4, asm.R7, asm.Word),
+		asm.LoadMapPtr(asm.R1, counters.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.LoadMem(asm.R1, asm.R0, 0, asm.DWord),
+		asm.Add.Imm(asm.R1, 1),
+		asm.StoreMem(asm.R0, 0, asm.R1, asm.DWord),
+		// skb->len
+		asm.LoadMem(asm.R2, asm.R6, 0, asm.Word),
+		asm.LoadMem(asm.R1, asm.R0, 8, asm.DWord),
+		asm.Add.Reg(asm.R1, asm.R2),
+		asm.StoreMem(asm.R0, 8, asm.R1, asm.DWord),
+
+		asm.Mov.Imm(asm.R0, -1).WithSymbol("exit"),
+		asm.Return(),
+	)
+	return insns
+}
+
+// Attach the counting programs to the host veth of the pod
+func attachBPFStats(h *netlink.Handle, s *tunnelState) error {
+	link, err := h.LinkByName(s.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", s.HostVeth, err)
+	}
+
+	counters, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.PerCPUArray,
+		KeySize:    4,
+		ValueSize:  16,
+		MaxEntries: 4,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create counters map: %v", err)
+	}
+	defer counters.Close()
+	if err := os.MkdirAll(bpfStatsDir, 0700); err != nil {
+		return err
+	}
+	if err := counters.Pin(bpfStatsPath(s.ID)); err != nil {
+		return fmt.Errorf("failed to pin counters map: %v", err)
+	}
+
+	if err := ensureClsact(h, link); err != nil {
+		return err
+	}
+	for _, dir := range []struct {
+		parent uint32
+		dir    int32
+	}{{netlink.HANDLE_MIN_INGRESS, bpfDirTx}, {netlink.HANDLE_MIN_EGRESS, bpfDirRx}} {
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Type:         ebpf.SchedCLS,
+			Instructions: bpfStatsProgram(counters, dir.dir),
+			License:      "GPL",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load stats program: %v", err)
+		}
+		// The filter keeps the program alive once we exit
+		err = h.FilterAdd(&netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    dir.parent,
+				Handle:    netlink.MakeHandle(0, 1),
+				Protocol:  unix.ETH_P_ALL,
+				Priority:  1,
+			},
+			Fd:           prog.FD(),
+			Name:         "strongswan-stats",
+			DirectAction: true,
+		})
+		prog.Close()
+		if err != nil {
+			return fmt.Errorf("failed to attach stats program to %q: %v", s.HostVeth, err)
+		}
+	}
+	return nil
+}
+
+// The programs go away with the veth, only the map is pinned
+func detachBPFStats(s *tunnelState) error {
+	if err := os.Remove(bpfStatsPath(s.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func ensureClsact(h *netlink.Handle, link netlink.Link) error {
+	qdiscs, err := h.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+	for _, q := range qdiscs {
+		if q.Type() == "clsact" {
+			return nil
+		}
+	}
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := h.QdiscAdd(clsact); err != nil {
+		return fmt.Errorf("failed to add clsact qdisc to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// Datapath counters of a pod, by direction and class, and the packets
+// dropped on its veth
+type podDatapath struct {
+	Tunneled  [2]bpfCounter `json:"tunneled"`
+	Plaintext [2]bpfCounter `json:"plaintext"`
+	TxDropped uint64        `json:"txDropped"`
+	RxDropped uint64        `json:"rxDropped"`
+}
+
+func readBPFStats(s *tunnelState) (*podDatapath, error) {
+	counters, err := ebpf.LoadPinnedMap(bpfStatsPath(s.ID), nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer counters.Close()
+
+	d := &podDatapath{}
+	for _, dir := range []int{bpfDirTx, bpfDirRx} {
+		for _, class := range []int{bpfClassTunneled, bpfClassPlaintext} {
+			var perCPU []bpfCounter
+			if err := counters.Lookup(uint32(dir*2+class), &perCPU); err != nil {
+				return nil, err
+			}
+			total := &d.Plaintext[dir]
+			if class == bpfClassTunneled {
+				total = &d.Tunneled[dir]
+			}
+			for _, c := range perCPU {
+				total.Packets += c.Packets
+				total.Bytes += c.Bytes
+			}
+		}
+	}
+
+	// The host veth receives what the pod sends
+	if link, err := netlink.LinkByName(s.HostVeth); err == nil && link.Attrs().Statistics != nil {
+		d.TxDropped = link.Attrs().Statistics.RxDropped
+		d.RxDropped = link.Attrs().Statistics.TxDropped
+	}
+	return d, nil
+}
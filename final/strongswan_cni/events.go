@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// Kubernetes Events about the tunnel of a pod, created with kubectl like the
+// excludeLabels lookups, using kubeconfig when set. Failing to create one is
+// only logged.
+type podEvent struct {
+	namespace, pod  string
+	reason, message string
+}
+
+func recordPodEvents(n *NetConf, events []podEvent) {
+	for _, e := range events {
+		if e.namespace == "" || e.pod == "" {
+			continue
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		event := map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Event",
+			"metadata": map[string]interface{}{
+				"generateName": e.pod + ".",
+				"namespace":    e.namespace,
+			},
+			"involvedObject": map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"namespace":  e.namespace,
+				"name":       e.pod,
+			},
+			"reason":         e.reason,
+			"message":        e.message,
+			"type":           "Warning",
+			"source":         map[string]interface{}{"component": "strongswan-cni"},
+			"firstTimestamp": now,
+			"lastTimestamp":  now,
+			"count":          1,
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+
+		args := []string{"create", "--filename", "-"}
+		if n.Kubeconfig != "" {
+			args = append([]string{"--kubeconfig", n.Kubeconfig}, args...)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command("kubectl", args...)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			log.Println(logPrefix, "failed to record event", e.reason, "for", e.namespace+"/"+e.pod+":", err, out.String())
+		}
+	}
+}
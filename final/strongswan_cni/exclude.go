@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os/exec"
+)
+
+// Pods of excludeNamespaces, and pods matching one of the label selectors of
+// excludeLabels, eg: system daemonsets, get plain bridge networking: no
+// tunnel, no charon and none of the host rules of tunnels. Labels aren't
+// part of the CNI call, they're looked up with kubectl, using kubeconfig
+// when set. When the lookup fails the pod isn't excluded, so it still
+// doesn't run without its tunnel.
+func excludedPod(n *NetConf, args string) bool {
+	namespace, pod := parseK8sArgs(args)
+	if namespace == "" {
+		return false
+	}
+	for _, excluded := range n.ExcludeNamespaces {
+		if namespace == excluded {
+			log.Println(logPrefix, "namespace", namespace, "is excluded, no tunnel for", pod)
+			return true
+		}
+	}
+
+	if pod == "" {
+		return false
+	}
+	for _, selector := range n.ExcludeLabels {
+		args := []string{"get", "pods", "--namespace", namespace, "--field-selector", "metadata.name=" + pod, "--selector", selector, "--output", "name"}
+		if n.Kubeconfig != "" {
+			args = append([]string{"--kubeconfig", n.Kubeconfig}, args...)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command("kubectl", args...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			log.Println(logPrefix, "failed to match", namespace+"/"+pod, "against excludeLabels:", err, stderr.String())
+			return false
+		}
+		if len(bytes.TrimSpace(out)) > 0 {
+			log.Println(logPrefix, namespace+"/"+pod, "matches", selector, "of excludeLabels, no tunnel for it")
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// What ADD does when the tunnel of the pod can't be established:
+// warn, the default, only logs it, error fails the ADD, so the pod isn't
+// started without its tunnel, fail-closed only logs it too but the pod can't
+// send anything outside of the tunnel, before it comes up or after it went
+// down.
+const (
+	failurePolicyError      = "error"
+	failurePolicyWarn       = "warn"
+	failurePolicyFailClosed = "fail-closed"
+
+	defaultTunnelTimeout = "60s"
+	failClosedChain      = "STRONGSWAN-FAILCLOSED"
+)
+
+func validateFailurePolicy(n *NetConf) error {
+	switch n.TunnelFailurePolicy {
+	case failurePolicyError:
+		if n.EstablishQueue {
+			return fmt.Errorf("establishQueue needs tunnelFailurePolicy %q or %q, ADD doesn't wait for queued tunnels", failurePolicyWarn, failurePolicyFailClosed)
+		}
+	case "", failurePolicyWarn, failurePolicyFailClosed:
+	default:
+		return fmt.Errorf("invalid tunnelFailurePolicy %q: must be %q, %q or %q", n.TunnelFailurePolicy, failurePolicyError, failurePolicyWarn, failurePolicyFailClosed)
+	}
+	return validateIpsecTime("tunnelTimeout", n.TunnelTimeout)
+}
+
+func failurePolicy(n *NetConf) string {
+	if n.TunnelFailurePolicy == "" {
+		return failurePolicyWarn
+	}
+	return n.TunnelFailurePolicy
+}
+
+// Wait for a CHILD_SA of the pod to be installed
+func waitForTunnel(s *tunnelState, timeout string) error {
+	if timeout == "" {
+		timeout = defaultTunnelTimeout
+	}
+	deadline := time.Now().Add(ipsecDuration(timeout))
+	for {
+		err := tunnelEstablished(s)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnel not established after %s: %v", timeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Drop whatever the pod sends outside of an IPsec policy, but the IKE and
+// ESP traffic to the gateway, loopback, and the replies to connections the
+// default gateways of the pod opened, which is where kubelet probes come from
+// on the bridge
+func setupFailClosed(netns ns.NetNS, vpnInfo vpnInfo) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list routes: %v", err)
+		}
+		var gateways []net.IP
+		for _, route := range routes {
+			if route.Dst == nil && route.Gw != nil {
+				gateways = append(gateways, route.Gw)
+			}
+		}
+		for _, family := range []struct {
+			restore string
+			v6      bool
+		}{{"iptables-restore", false}, {"ip6tables-restore", true}} {
+			cmd := exec.Command(family.restore, "--noflush")
+			cmd.Stdin = strings.NewReader(failClosedRules(vpnInfo.ServerIP, gateways, family.v6))
+			var out bytes.Buffer
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("failed to install fail-closed rules: %v: %s", err, out.String())
+			}
+		}
+		return nil
+	})
+}
+
+// Generate the filter table of a family for iptables-restore
+func failClosedRules(serverIP string, gateways []net.IP, v6 bool) string {
+	var b bytes.Buffer
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", failClosedChain)
+	fmt.Fprintf(&b, "-A %s -o lo -j RETURN\n", failClosedChain)
+	fmt.Fprintf(&b, "-A %s -m policy --dir out --pol ipsec -j RETURN\n", failClosedChain)
+	if server := net.ParseIP(serverIP); server != nil && (server.To4() == nil) == v6 {
+		fmt.Fprintf(&b, "-A %s -d %s -p udp -m multiport --dports 500,4500 -j RETURN\n", failClosedChain, server)
+		fmt.Fprintf(&b, "-A %s -d %s -p esp -j RETURN\n", failClosedChain, server)
+	}
+	for _, gw := range gateways {
+		if (gw.To4() == nil) == v6 {
+			// Only replies, the pod can't open connections to the node
+			fmt.Fprintf(&b, "-A %s -d %s -m conntrack --ctstate ESTABLISHED,RELATED --ctdir REPLY -j RETURN\n", failClosedChain, gw)
+		}
+	}
+	fmt.Fprintf(&b, "-A %s -j DROP\n", failClosedChain)
+	fmt.Fprintf(&b, "-A OUTPUT -j %s\n", failClosedChain)
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// Count and log a tunnel which couldn't be established while ADD goes on
+func tunnelFailed(n *NetConf, s *tunnelState, err error) {
+	policy := failurePolicy(n)
+	log.Println(logPrefix, "failed to establish the tunnel of", s.ContainerID+", going on with policy", policy+":", err)
+	unlock, lockErr := lockState()
+	if lockErr != nil {
+		return
+	}
+	defer unlock()
+	updateMetrics(n.MetricsDir, func(m *metrics) {
+		m.inc(fmt.Sprintf(`strongswan_cni_tunnel_failures_total{policy=%q}`, policy))
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFailClosedRules(t *testing.T) {
+	gateways := []net.IP{net.ParseIP("10.244.1.1"), net.ParseIP("fd00::1")}
+	for _, tc := range []struct {
+		name     string
+		serverIP string
+		v6       bool
+		want     []string
+		unwanted []string
+	}{
+		{
+			"v4 server",
+			"192.0.2.1",
+			false,
+			[]string{
+				"-d 192.0.2.1 -p udp -m multiport --dports 500,4500 -j RETURN",
+				"-d 192.0.2.1 -p esp -j RETURN",
+				"-d 10.244.1.1 -m conntrack",
+			},
+			[]string{"fd00::1"},
+		},
+		{
+			"v4 server in the v6 table",
+			"192.0.2.1",
+			true,
+			[]string{"-d fd00::1 -m conntrack"},
+			[]string{"192.0.2.1", "10.244.1.1"},
+		},
+		{
+			"v6 server",
+			"2001:db8::1",
+			true,
+			[]string{"-d 2001:db8::1 -p esp -j RETURN"},
+			nil,
+		},
+		{
+			"server name",
+			"vpn.example.com",
+			false,
+			nil,
+			[]string{"vpn.example.com"},
+		},
+	} {
+		rules := failClosedRules(tc.serverIP, gateways, tc.v6)
+		lines := strings.Split(strings.TrimSuffix(rules, "\n"), "\n")
+		if lines[0] != "*filter" || lines[len(lines)-1] != "COMMIT" {
+			t.Errorf("%s: not a filter table: %q", tc.name, rules)
+			continue
+		}
+		// Everything else is dropped, after the exceptions
+		if drop := "-A " + failClosedChain + " -j DROP"; lines[len(lines)-3] != drop {
+			t.Errorf("%s: got %q before the jump, want %q", tc.name, lines[len(lines)-3], drop)
+		}
+		for _, rule := range tc.want {
+			if !strings.Contains(rules, rule) {
+				t.Errorf("%s: %q is missing from %q", tc.name, rule, rules)
+			}
+		}
+		for _, s := range tc.unwanted {
+			if strings.Contains(rules, s) {
+				t.Errorf("%s: unexpected %q in %q", tc.name, s, rules)
+			}
+		}
+	}
+}
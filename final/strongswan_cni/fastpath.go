@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// With fastPath, plaintext IPv4 packets a pod sends to another pod of the
+// same network on the node skip the bridge: a tc program on the ingress of
+// the host veth looks the destination up in a map of the local pods and
+// hands the packet straight to the namespace of the destination pod with
+// bpf_redirect_peer, which needs Linux 5.10. Traffic covered by an IPsec
+// policy leaves the pod as ESP to the server, so it's never redirected and
+// keeps going through the bridge. Redirected packets skip the host
+// netfilter hooks, so host iptables, NetworkPolicy and markMask rules don't
+// apply to them. The map is shared by the pods of a network and pinned next
+// to the stats maps.
+type fastPathEntry struct {
+	// Index of the host veth of the pod
+	Ifindex uint32
+	// Address of the pod end of the veth
+	MAC [6]byte
+	_   [2]byte
+}
+
+func fastPathPath(network string) string {
+	return filepath.Join(bpfStatsDir, "fastpath-"+network)
+}
+
+// Redirect the packets to a local pod to its veth, others go on through the
+// bridge
+func fastPathProgram(pods *ebpf.Map) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		// skb->protocol, in network byte order
+		asm.LoadMem(asm.R2, asm.R6, 16, asm.Word),
+		asm.JNE.Imm(asm.R2, int32(htons(unix.ETH_P_IP)), "exit"),
+
+		// Destination address
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, 14+16),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -8),
+		asm.Mov.Imm(asm.R4, 4),
+		asm.FnSkbLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "exit"),
+
+		asm.LoadMapPtr(asm.R1, pods.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.Mov.Reg(asm.R7, asm.R0),
+		asm.LoadMem(asm.R8, asm.R7, 0, asm.Word),
+
+		// The pod may have addressed the gateway, deliver to the peer
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.Mov.Reg(asm.R3, asm.R7),
+		asm.Add.Imm(asm.R3, 4),
+		asm.Mov.Imm(asm.R4, 6),
+		asm.Mov.Imm(asm.R5, 0),
+		asm.FnSkbStoreBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "exit"),
+
+		asm.Mov.Reg(asm.R1, asm.R8),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.FnRedirectPeer.Call(),
+		asm.Return(),
+
+		asm.Mov.Imm(asm.R0, -1).WithSymbol("exit"),
+		asm.Return(),
+	}
+}
+
+// Open the map of the local pods of a network, creating it for the first pod
+func openFastPathMap(network string) (*ebpf.Map, error) {
+	pods, err := ebpf.LoadPinnedMap(fastPathPath(network), nil)
+	if err == nil {
+		return pods, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pods, err = ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  12,
+		MaxEntries: 4096,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fast path map: %v", err)
+	}
+	if err := os.MkdirAll(bpfStatsDir, 0700); err != nil {
+		pods.Close()
+		return nil, err
+	}
+	if err := pods.Pin(fastPathPath(network)); err != nil {
+		pods.Close()
+		return nil, fmt.Errorf("failed to pin fast path map: %v", err)
+	}
+	return pods, nil
+}
+
+// Add the pod to the map of its network and attach the redirecting program
+// to its host veth. It runs after the stats program, which lets packets go
+// on.
+func setupFastPath(h *netlink.Handle, s *tunnelState, podMAC string) error {
+	link, err := h.LinkByName(s.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", s.HostVeth, err)
+	}
+	mac, err := net.ParseMAC(podMAC)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %v", podMAC, err)
+	}
+
+	pods, err := openFastPathMap(s.Network)
+	if err != nil {
+		return err
+	}
+	defer pods.Close()
+
+	entry := fastPathEntry{Ifindex: uint32(link.Attrs().Index)}
+	copy(entry.MAC[:], mac)
+	for _, ip := range s.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			if err := pods.Put([]byte(ip4), &entry); err != nil {
+				return fmt.Errorf("failed to add %v to the fast path map: %v", ip, err)
+			}
+		}
+	}
+
+	if err := ensureClsact(h, link); err != nil {
+		return err
+	}
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.SchedCLS,
+		Instructions: fastPathProgram(pods),
+		License:      "GPL",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load fast path program: %v", err)
+	}
+	defer prog.Close()
+	err = h.FilterAdd(&netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    netlink.MakeHandle(0, 2),
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  2,
+		},
+		Fd:           prog.FD(),
+		Name:         "strongswan-fastpath",
+		DirectAction: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach fast path program to %q: %v", s.HostVeth, err)
+	}
+	return nil
+}
+
+// Remove the addresses of the pod from the map, the program goes away with
+// the veth
+func removeFastPath(s *tunnelState) error {
+	pods, err := ebpf.LoadPinnedMap(fastPathPath(s.Network), nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer pods.Close()
+
+	for _, ip := range s.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			if err := pods.Delete([]byte(ip4)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// When to let the IKE and ESP traffic of the pods through the host firewall
+const (
+	hostFirewallAuto = "auto"
+	hostFirewallOn   = "on"
+	hostFirewallOff  = "off"
+
+	hostFirewallChain = "STRONGSWAN-FW"
+)
+
+func validateHostFirewall(mode string) error {
+	switch mode {
+	case "", hostFirewallAuto, hostFirewallOn, hostFirewallOff:
+		return nil
+	}
+	return fmt.Errorf("invalid hostFirewall %q: must be %q, %q or %q", mode, hostFirewallAuto, hostFirewallOn, hostFirewallOff)
+}
+
+// Chain holding the rules of a pod, jumped to from hostFirewallChain
+func hostFirewallPodChain(network, containerID string) string {
+	return utils.FormatChainName("fw-"+network, containerID)
+}
+
+func hostFirewallIPTables(serverIP string) (*iptables.IPTables, error) {
+	proto := iptables.ProtocolIPv4
+	if ip := net.ParseIP(serverIP); ip != nil && ip.To4() == nil {
+		proto = iptables.ProtocolIPv6
+	}
+	return iptables.NewWithProtocol(proto)
+}
+
+// charon runs in the pod, so its packets are forwarded by the host. Nodes
+// whose FORWARD chain drops by default, eg: with docker or ufw, or which
+// drop or reject some forwarded traffic, silently break the negotiation.
+// In auto mode, rules are only added on such nodes.
+func needsHostFirewall(ipt *iptables.IPTables, mode string) (bool, error) {
+	switch mode {
+	case hostFirewallOn:
+		return true, nil
+	case hostFirewallOff:
+		return false, nil
+	}
+
+	rules, err := ipt.List("filter", "FORWARD")
+	if err != nil {
+		return false, fmt.Errorf("failed to list FORWARD rules: %v", err)
+	}
+	for _, rule := range rules {
+		if rule == "-P FORWARD DROP" || strings.HasSuffix(rule, "-j DROP") || strings.Contains(rule, "-j REJECT") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Accept IKE, NAT-T and ESP between the pod and the VPN server, in both
+// directions, ahead of any other FORWARD rule
+func openHostFirewall(n *NetConf, s *tunnelState) error {
+	chain := hostFirewallPodChain(n.Name, s.ContainerID)
+	comment := utils.FormatComment(n.Name, s.ContainerID)
+	rules := hostFirewallRules(n.VPN.ServerIP, s.IPs)
+
+	// Zones reject forwarded traffic by default, whatever the backend
+	fw, err := connectFirewalld()
+	if err != nil {
+		return err
+	}
+	if fw != nil {
+		if n.HostFirewall == hostFirewallOff {
+			return nil
+		}
+		return fw.openHostFirewall(firewalldIPV(net.ParseIP(n.VPN.ServerIP)), chain, comment, rules)
+	}
+
+	ipt, err := hostFirewallIPTables(n.VPN.ServerIP)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	needed, err := needsHostFirewall(ipt, n.HostFirewall)
+	if err != nil || !needed {
+		return err
+	}
+
+	if err := ensureChain(ipt, "filter", hostFirewallChain); err != nil {
+		return err
+	}
+	exists, err := ipt.Exists("filter", "FORWARD", "-j", hostFirewallChain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := ipt.Insert("filter", "FORWARD", 1, "-j", hostFirewallChain); err != nil {
+			return err
+		}
+	}
+
+	if err := ipt.ClearChain("filter", chain); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := ipt.Append("filter", chain, rule...); err != nil {
+			return err
+		}
+	}
+	return ipt.AppendUnique("filter", hostFirewallChain, "-j", chain, "-m", "comment", "--comment", comment)
+}
+
+// Rules accepting the tunnel traffic between the pod addresses of the
+// family of the server and the server
+func hostFirewallRules(server string, ips []net.IP) [][]string {
+	v6 := net.ParseIP(server).To4() == nil
+	var rules [][]string
+	for _, ip := range ips {
+		if (ip.To4() == nil) != v6 {
+			continue
+		}
+		pod := ip.String()
+		for _, match := range [][]string{
+			{"-p", "udp", "-m", "multiport", "--ports", "500,4500"},
+			{"-p", "esp"},
+		} {
+			for _, dir := range [][]string{{"-s", pod, "-d", server}, {"-s", server, "-d", pod}} {
+				rule := append(append(append([]string{}, dir...), match...), "-j", "ACCEPT")
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// Remove the rules of a pod, whatever the mode is now, from the network and
+// server of its state
+func closeHostFirewall(s *tunnelState) error {
+	chain := hostFirewallPodChain(s.Network, s.ContainerID)
+	comment := utils.FormatComment(s.Network, s.ContainerID)
+
+	fw, err := connectFirewalld()
+	if err != nil {
+		return err
+	}
+	if fw != nil {
+		return fw.closeHostFirewall(firewalldIPV(net.ParseIP(s.VPN.ServerIP)), chain, comment)
+	}
+
+	ipt, err := hostFirewallIPTables(s.VPN.ServerIP)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	exists, err := chainExists(ipt, "filter", chain)
+	if err != nil || !exists {
+		return err
+	}
+
+	if err := ipt.Delete("filter", hostFirewallChain, "-j", chain, "-m", "comment", "--comment", comment); err != nil {
+		return err
+	}
+	if err := ipt.ClearChain("filter", chain); err != nil {
+		return err
+	}
+	return ipt.DeleteChain("filter", chain)
+}
+
+func chainExists(ipt *iptables.IPTables, table, chain string) (bool, error) {
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return false, fmt.Errorf("failed to list chains: %v", err)
+	}
+	for _, ch := range chains {
+		if ch == chain {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func ensureChain(ipt *iptables.IPTables, table, chain string) error {
+	exists, err := chainExists(ipt, table, chain)
+	if err != nil || exists {
+		return err
+	}
+	return ipt.NewChain(table, chain)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHostFirewallRules(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.244.1.7"), net.ParseIP("fd00::7")}
+	for _, tc := range []struct {
+		name   string
+		server string
+		want   [][]string
+	}{
+		{"v4 server", "192.0.2.1", [][]string{
+			{"-s", "10.244.1.7", "-d", "192.0.2.1", "-p", "udp", "-m", "multiport", "--ports", "500,4500", "-j", "ACCEPT"},
+			{"-s", "192.0.2.1", "-d", "10.244.1.7", "-p", "udp", "-m", "multiport", "--ports", "500,4500", "-j", "ACCEPT"},
+			{"-s", "10.244.1.7", "-d", "192.0.2.1", "-p", "esp", "-j", "ACCEPT"},
+			{"-s", "192.0.2.1", "-d", "10.244.1.7", "-p", "esp", "-j", "ACCEPT"},
+		}},
+		{"v6 server", "2001:db8::1", [][]string{
+			{"-s", "fd00::7", "-d", "2001:db8::1", "-p", "udp", "-m", "multiport", "--ports", "500,4500", "-j", "ACCEPT"},
+			{"-s", "2001:db8::1", "-d", "fd00::7", "-p", "udp", "-m", "multiport", "--ports", "500,4500", "-j", "ACCEPT"},
+			{"-s", "fd00::7", "-d", "2001:db8::1", "-p", "esp", "-j", "ACCEPT"},
+			{"-s", "2001:db8::1", "-d", "fd00::7", "-p", "esp", "-j", "ACCEPT"},
+		}},
+	} {
+		if got := hostFirewallRules(tc.server, ips); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if got := hostFirewallRules("192.0.2.1", ips[1:]); len(got) != 0 {
+		t.Errorf("got %v for a v4 server and v6 pod", got)
+	}
+}
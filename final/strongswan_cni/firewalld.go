@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	firewalldName   = "org.fedoraproject.FirewallD1"
+	firewalldPath   = "/org/fedoraproject/FirewallD1"
+	firewalldDirect = "org.fedoraproject.FirewallD1.direct"
+)
+
+// On firewalld-managed nodes, rules inserted with iptables are wiped by every
+// firewalld reload. The masquerade and host firewall rules are added as
+// firewalld direct rules over D-Bus instead: unlike rich rules and services,
+// they take iptables arguments as is, so the rules are the same as without
+// firewalld, and they go into chains of their own. They are only added at
+// runtime, so they don't outlive a reboot like the pods, and recorded in
+// firewalldRulesPath, from which the daemon adds them back after each reload.
+var firewalldRulesPath = writablePath("/run/strongswan-cni/firewalld.json")
+
+type firewalld struct {
+	runtime dbus.BusObject
+}
+
+// A direct chain, when Args is nil, or a rule of the chain
+type firewalldRule struct {
+	IPV   string   `json:"ipv"`
+	Table string   `json:"table"`
+	Chain string   `json:"chain"`
+	Args  []string `json:"args,omitempty"`
+}
+
+// Connect to firewalld, nil when it isn't running
+func connectFirewalld() (*firewalld, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		// No system bus, so no firewalld either
+		return nil, nil
+	}
+	var running bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, firewalldName).Store(&running); err != nil {
+		return nil, fmt.Errorf("failed to look for firewalld: %v", err)
+	}
+	if !running {
+		return nil, nil
+	}
+	return &firewalld{runtime: conn.Object(firewalldName, firewalldPath)}, nil
+}
+
+func firewalldIPV(addr net.IP) string {
+	if addr.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// Call a direct method. Adding what is already there and removing what isn't
+// are no-ops.
+func (f *firewalld) call(method string, args ...interface{}) error {
+	err := f.runtime.Call(firewalldDirect+"."+method, 0, args...).Err
+	if err != nil && !strings.Contains(err.Error(), "ALREADY_ENABLED") && !strings.Contains(err.Error(), "NOT_ENABLED") {
+		return fmt.Errorf("firewalld %s failed: %v", method, err)
+	}
+	return nil
+}
+
+// Update the recorded direct rules under their own lock, ADD may hold the
+// state lock
+func updateFirewalldRules(fn func([]firewalldRule) []firewalldRule) error {
+	if err := os.MkdirAll(filepath.Dir(firewalldRulesPath), 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(firewalldRulesPath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %q: %v", firewalldRulesPath, err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	var rules []firewalldRule
+	data, err := ioutil.ReadFile(firewalldRulesPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("failed to parse %q: %v", firewalldRulesPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if fn == nil {
+		return nil
+	}
+	data, err = json.Marshal(fn(rules))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(firewalldRulesPath, data, 0600)
+}
+
+func recordFirewalldRule(rule firewalldRule) error {
+	return updateFirewalldRules(func(rules []firewalldRule) []firewalldRule {
+		for _, r := range rules {
+			if reflect.DeepEqual(r, rule) {
+				return rules
+			}
+		}
+		return append(rules, rule)
+	})
+}
+
+// Forget rule, or a chain and its rules
+func forgetFirewalldRule(rule firewalldRule) error {
+	return updateFirewalldRules(func(rules []firewalldRule) []firewalldRule {
+		var kept []firewalldRule
+		for _, r := range rules {
+			if r.IPV == rule.IPV && r.Table == rule.Table && r.Chain == rule.Chain &&
+				(rule.Args == nil || reflect.DeepEqual(r.Args, rule.Args)) {
+				continue
+			}
+			kept = append(kept, r)
+		}
+		return kept
+	})
+}
+
+// Add the recorded chains and rules back, in the order they were added,
+// eg: after firewalld dropped them on reload
+func (f *firewalld) restoreRules() error {
+	var rules []firewalldRule
+	if err := updateFirewalldRules(func(recorded []firewalldRule) []firewalldRule {
+		rules = recorded
+		return recorded
+	}); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		var err error
+		if r.Args == nil {
+			err = f.call("addChain", r.IPV, r.Table, r.Chain)
+		} else {
+			err = f.call("addRule", r.IPV, r.Table, r.Chain, int32(0), r.Args)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the rules back whenever firewalld reloads, and once at start in case
+// it reloaded while the daemon wasn't running. Returns when there's no
+// system bus.
+func watchFirewalldReloads() {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return
+	}
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface(firewalldName), dbus.WithMatchMember("Reloaded")); err != nil {
+		log.Println(logPrefix, "failed to watch firewalld reloads:", err)
+		return
+	}
+	signals := make(chan *dbus.Signal, 8)
+	conn.Signal(signals)
+
+	restore := func() {
+		fw, err := connectFirewalld()
+		if err != nil || fw == nil {
+			return
+		}
+		if err := fw.restoreRules(); err != nil {
+			log.Println(logPrefix, "failed to restore firewalld rules:", err)
+		}
+	}
+	restore()
+	for signal := range signals {
+		if signal.Name == firewalldName+".Reloaded" {
+			log.Println(logPrefix, "firewalld reloaded, restoring its direct rules")
+			restore()
+		}
+	}
+}
+
+// The runtime direct rules of a chain, for the families of ipns
+func (f *firewalld) chainRules(ipns []*net.IPNet, table, chain string) [][]string {
+	var rules [][]string
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		if !hasFamily(ipns, ipv == "ipv6") {
+			continue
+		}
+		var found []struct {
+			Priority int32
+			Args     []string
+		}
+		if err := f.runtime.Call(firewalldDirect+".getRules", 0, ipv, table, chain).Store(&found); err != nil {
+			continue
+		}
+		for _, rule := range found {
+			rules = append(rules, rule.Args)
+		}
+	}
+	return rules
+}
+
+func (f *firewalld) addChain(ipv, table, chain string) error {
+	if err := f.call("addChain", ipv, table, chain); err != nil {
+		return err
+	}
+	return recordFirewalldRule(firewalldRule{IPV: ipv, Table: table, Chain: chain})
+}
+
+func (f *firewalld) removeChain(ipv, table, chain string) error {
+	if err := f.call("removeRules", ipv, table, chain); err != nil {
+		return err
+	}
+	if err := f.call("removeChain", ipv, table, chain); err != nil {
+		return err
+	}
+	return forgetFirewalldRule(firewalldRule{IPV: ipv, Table: table, Chain: chain})
+}
+
+func (f *firewalld) addRule(ipv, table, chain string, args []string) error {
+	if err := f.call("addRule", ipv, table, chain, int32(0), args); err != nil {
+		return err
+	}
+	return recordFirewalldRule(firewalldRule{IPV: ipv, Table: table, Chain: chain, Args: args})
+}
+
+func (f *firewalld) removeRule(ipv, table, chain string, args []string) error {
+	if err := f.call("removeRule", ipv, table, chain, int32(0), args); err != nil {
+		return err
+	}
+	return forgetFirewalldRule(firewalldRule{IPV: ipv, Table: table, Chain: chain, Args: args})
+}
+
+// Same rules as ip.SetupIPMasq
+func (f *firewalld) setupIPMasq(ipn *net.IPNet, chain, comment string) error {
+	ipv := firewalldIPV(ipn.IP)
+	multicastNet := "224.0.0.0/4"
+	if ipv == "ipv6" {
+		multicastNet = "ff00::/8"
+	}
+
+	if err := f.addChain(ipv, "nat", chain); err != nil {
+		return err
+	}
+	if err := f.addRule(ipv, "nat", chain, []string{"-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment}); err != nil {
+		return err
+	}
+	if err := f.addRule(ipv, "nat", chain, []string{"!", "-d", multicastNet, "-j", "MASQUERADE", "-m", "comment", "--comment", comment}); err != nil {
+		return err
+	}
+	return f.addRule(ipv, "nat", "POSTROUTING", []string{"-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment})
+}
+
+func (f *firewalld) teardownIPMasq(ipns []*net.IPNet, chain, comment string) error {
+	for _, ipn := range ipns {
+		network := ip.Network(ipn)
+		if err := f.removeRule(firewalldIPV(ipn.IP), "nat", "POSTROUTING", []string{"-s", network.String(), "-j", chain, "-m", "comment", "--comment", comment}); err != nil {
+			return err
+		}
+	}
+	for _, v6 := range []bool{false, true} {
+		if !hasFamily(ipns, v6) {
+			continue
+		}
+		ipv := "ipv4"
+		if v6 {
+			ipv = "ipv6"
+		}
+		if err := f.removeChain(ipv, "nat", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Direct rules in FORWARD go into its FORWARD_direct chain, which firewalld
+// evaluates before the zones
+func (f *firewalld) openHostFirewall(ipv, chain, comment string, rules [][]string) error {
+	if err := f.addChain(ipv, "filter", chain); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := f.addRule(ipv, "filter", chain, rule); err != nil {
+			return err
+		}
+	}
+	return f.addRule(ipv, "filter", "FORWARD", []string{"-j", chain, "-m", "comment", "--comment", comment})
+}
+
+func (f *firewalld) closeHostFirewall(ipv, chain, comment string) error {
+	if err := f.removeRule(ipv, "filter", "FORWARD", []string{"-j", chain, "-m", "comment", "--comment", comment}); err != nil {
+		return err
+	}
+	return f.removeChain(ipv, "filter", chain)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	nlns "github.com/vishvananda/netns"
+)
+
+// gc command: clean up what missed or failed DELs leave behind on
+// long-lived nodes. The daemon also runs it periodically.
+func gcCommand(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	bridge := flags.String("bridge", "", "bridge of the pods, those of every network by default")
+	podCIDRs := flags.String("pod-cidr", "", "comma separated subnets of the pods, whose stale xfrm states and policies are cleaned up")
+	dryRun := flags.Bool("dry-run", false, "only log what would be cleaned up")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cidrs, err := parsePodCIDRs(*podCIDRs)
+	if err != nil {
+		return err
+	}
+	return collectGarbage(gcOptions{bridge: *bridge, podCIDRs: cidrs, dryRun: *dryRun})
+}
+
+type gcOptions struct {
+	bridge   string
+	podCIDRs []*net.IPNet
+	dryRun   bool
+}
+
+func parsePodCIDRs(list string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod CIDR %q: %v", cidr, err)
+		}
+		cidrs = append(cidrs, ipnet)
+	}
+	return cidrs, nil
+}
+
+func collectGarbage(o gcOptions) error {
+	return joinErrors([]error{
+		gcVeths(o),
+		gcCharons(o),
+		gcXfrm(o),
+	})
+}
+
+// Delete the veth ports of the bridges whose peer is in a namespace without
+// any process left, eg: one a failed DEL left mounted. containerd and CRI-O
+// pin the namespace of a sandbox under /var/run/netns and run ADD before any
+// process is started in it, so pinned namespaces count as live too, as do
+// the veths of the tunnel states. The state lock keeps ADD and DEL from
+// changing the states while the ports are scanned.
+func gcVeths(o gcOptions) error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	states, err := loadTunnelStates()
+	if err != nil {
+		return err
+	}
+
+	bridges := []string{o.bridge}
+	if o.bridge == "" {
+		if bridges, err = networkBridges(states); err != nil {
+			return err
+		}
+	}
+	indexes := map[int]string{}
+	for _, bridge := range bridges {
+		br, err := netlink.LinkByName(bridge)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				continue
+			}
+			return err
+		}
+		indexes[br.Attrs().Index] = bridge
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	peers := liveVethPeers()
+	tunnelVeths := map[string]bool{}
+	for _, s := range states {
+		tunnelVeths[s.HostVeth] = true
+	}
+
+	for _, link := range links {
+		attrs := link.Attrs()
+		bridge, ok := indexes[attrs.MasterIndex]
+		// Peers in the host namespace itself have no namespace id
+		if link.Type() != "veth" || !ok || attrs.NetNsID < 0 || peers[attrs.Index] || tunnelVeths[attrs.Name] {
+			continue
+		}
+		log.Println(logPrefix, "deleting orphaned veth", attrs.Name, "of", bridge)
+		if o.dryRun {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			log.Println(logPrefix, "failed to delete", attrs.Name+":", err)
+		}
+	}
+	return nil
+}
+
+// Where runtimes, and ip netns, pin network namespaces
+var pinnedNetNSGlobs = []string{"/var/run/netns/*", "/run/netns/*"}
+
+// Host interface indexes the veths of the namespaces of running processes,
+// or pinned ones, are paired with. Indexes are per namespace, so one paired
+// with another namespace may be counted too, which only keeps a port.
+func liveVethPeers() map[int]bool {
+	peers := map[int]bool{}
+	var host syscall.Stat_t
+	syscall.Stat("/proc/self/ns/net", &host)
+	seen := map[uint64]bool{host.Ino: true}
+
+	paths, _ := filepath.Glob("/proc/[0-9]*/ns/net")
+	for _, glob := range pinnedNetNSGlobs {
+		pinned, _ := filepath.Glob(glob)
+		paths = append(paths, pinned...)
+	}
+	for _, path := range paths {
+		// Processes may exit while we're at it
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil || seen[st.Ino] {
+			continue
+		}
+		seen[st.Ino] = true
+
+		ns, err := nlns.GetFromPath(path)
+		if err != nil {
+			continue
+		}
+		h, err := netlink.NewHandleAt(ns)
+		ns.Close()
+		if err != nil {
+			continue
+		}
+		links, err := h.LinkList()
+		h.Delete()
+		if err != nil {
+			continue
+		}
+		for _, link := range links {
+			if link.Type() == "veth" && link.Attrs().ParentIndex > 0 {
+				peers[link.Attrs().ParentIndex] = true
+			}
+		}
+	}
+	return peers
+}
+
+// Stop the charon processes of pods which are gone, and remove their
+// configuration, secrets included: those of tunnels whose namespace is gone,
+// and those without any tunnel state. Their state is left for DEL, which
+// also removes their host rules, to find.
+func gcCharons(o gcOptions) error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	states, err := loadTunnelStates()
+	unlock()
+	if err != nil {
+		return err
+	}
+	byID := map[string]*tunnelState{}
+	for _, s := range states {
+		byID[s.ID] = s
+	}
+
+	dirs, err := filepath.Glob(netnsConfDir("*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		// Others may use ip netns exec too
+		if _, err := os.Stat(filepath.Join(dir, "ipsec.d", "run")); err != nil {
+			continue
+		}
+		id := strings.TrimPrefix(filepath.Base(dir), "ns-")
+		s := byID[id]
+		reason := "its namespace is gone"
+		if s == nil {
+			// ADD writes the configuration right after the state, and
+			// DEL removes the state right after the configuration
+			info, err := os.Stat(dir)
+			if err != nil || time.Since(info.ModTime()) < restoreGracePeriod {
+				continue
+			}
+			reason = "it has no tunnel state"
+		} else if podNetNSAlive(s) {
+			continue
+		}
+
+		pids := charonPids(id)
+		log.Println(logPrefix, "stopping orphaned charon of", id+",", reason+", pids:", pids)
+		if o.dryRun {
+			continue
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGTERM)
+		}
+		os.RemoveAll(dir)
+		if !rootless {
+			os.Remove("/var/run/netns/ns-" + id)
+		}
+	}
+	return nil
+}
+
+// The running starter and charon of a pod, from their pid files. starter
+// comes first, so it's stopped before it could restart charon.
+func charonPids(id string) []int {
+	var pids []int
+	for _, p := range []struct{ name, file string }{
+		{"starter", "starter.charon.pid"},
+		{"charon", "charon.pid"},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(netnsConfDir(id), "ipsec.d", "run", p.file))
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			continue
+		}
+		// Pids are reused, make sure it's still the same program
+		comm, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == p.name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Where host-local records the addresses it allocated, one file per address
+const hostLocalDir = "/var/lib/cni/networks"
+
+// Delete the xfrm states and policies of the host whose addresses or host
+// selectors are in the pod subnets but allocated to no pod anymore. Once the
+// address is reused, they would blackhole or misroute the traffic of the new
+// pod. Subnet wide selectors are left alone.
+func gcXfrm(o gcOptions) error {
+	if len(o.podCIDRs) == 0 {
+		return nil
+	}
+	allocated, err := allocatedPodIPs()
+	if err != nil {
+		return err
+	}
+	stale := func(ip net.IP) bool {
+		if ip == nil || allocated[ip.String()] {
+			return false
+		}
+		for _, cidr := range o.podCIDRs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	hostIP := func(ipnet *net.IPNet) net.IP {
+		if ipnet == nil {
+			return nil
+		}
+		if ones, bits := ipnet.Mask.Size(); ones != bits {
+			return nil
+		}
+		return ipnet.IP
+	}
+
+	policies, err := netlink.XfrmPolicyList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list xfrm policies: %v", err)
+	}
+	for _, p := range policies {
+		if !stale(hostIP(p.Src)) && !stale(hostIP(p.Dst)) {
+			continue
+		}
+		log.Println(logPrefix, "deleting stale xfrm policy", p.Src, "->", p.Dst, p.Dir)
+		if o.dryRun {
+			continue
+		}
+		if err := netlink.XfrmPolicyDel(&p); err != nil {
+			log.Println(logPrefix, "failed to delete xfrm policy:", err)
+		}
+	}
+
+	states, err := netlink.XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list xfrm states: %v", err)
+	}
+	for _, st := range states {
+		if !stale(st.Src) && !stale(st.Dst) {
+			continue
+		}
+		log.Println(logPrefix, "deleting stale xfrm state", st.Src, "->", st.Dst, "spi", fmt.Sprintf("%#x", st.Spi))
+		if o.dryRun {
+			continue
+		}
+		if err := netlink.XfrmStateDel(&st); err != nil {
+			log.Println(logPrefix, "failed to delete xfrm state:", err)
+		}
+	}
+	return nil
+}
+
+// The addresses of the pods: those of the tunnels, and those host-local
+// allocated, for pods being added
+func allocatedPodIPs() (map[string]bool, error) {
+	unlock, err := lockState()
+	if err != nil {
+		return nil, err
+	}
+	states, err := loadTunnelStates()
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	allocated := map[string]bool{}
+	for _, s := range states {
+		for _, ip := range s.IPs {
+			allocated[ip.String()] = true
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(hostLocalDir, "*", "*"))
+	for _, f := range files {
+		if ip := net.ParseIP(filepath.Base(f)); ip != nil {
+			allocated[ip.String()] = true
+		}
+	}
+	return allocated, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePodCIDRs(t *testing.T) {
+	for _, tc := range []struct {
+		list string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"10.244.0.0/16", []string{"10.244.0.0/16"}, true},
+		{" 10.244.0.0/16 , fd00:10:244::/56,", []string{"10.244.0.0/16", "fd00:10:244::/56"}, true},
+		{"10.244.1.7/16", []string{"10.244.0.0/16"}, true},
+		{"10.244.0.0", nil, false},
+		{"10.244.0.0/16,pods", nil, false},
+	} {
+		cidrs, err := parsePodCIDRs(tc.list)
+		if (err == nil) != tc.ok {
+			t.Errorf("parsePodCIDRs(%q): got error %v", tc.list, err)
+			continue
+		}
+		var got []string
+		for _, cidr := range cidrs {
+			got = append(got, cidr.String())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parsePodCIDRs(%q) = %v, want %v", tc.list, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The IKE handshake latency of a pod is the time from charon being told to
+// initiate its connection to its CHILD_SA being installed, which the pod
+// waits for before it can reach anything through the tunnel. The bringup
+// script, and update, touch a marker file right before initiating, the
+// updown command measures its age when the CHILD_SA comes up then removes
+// it, so rekeys and CHILD_SAs coming up again later aren't measured.
+const ikeHandshakeSeries = "strongswan_cni_ike_handshake_seconds"
+
+// Buckets of the handshake latency histogram: a handshake takes well under a
+// second, retransmits and DPD push it to tens of seconds
+var ikeHandshakeBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Path of the marker on the host; under ipsec.d, it's also where charon
+// keeps its pid file
+func handshakeMarker(id string) string {
+	return filepath.Join(netnsConfDir(id), "ipsec.d", "run", "initiated")
+}
+
+// Mark the connection of the pod as being initiated now
+func markInitiated(id string) error {
+	marker := handshakeMarker(id)
+	f, err := os.Create(marker)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %v", marker, err)
+	}
+	return f.Close()
+}
+
+// Record the handshake latency of the CHILD_SA which just came up, if the
+// connection was being initiated. Runs from the updown command.
+func observeHandshake(s *tunnelState) error {
+	marker := handshakeMarker(s.ID)
+	info, err := os.Stat(marker)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	took := time.Since(info.ModTime())
+	if err := os.Remove(marker); err != nil {
+		return err
+	}
+	log.Println(logPrefix, "IKE handshake of", s.ContainerID, "took", took)
+	seconds := took.Seconds()
+
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Loaded again, the state may have changed since the updown started
+	s, err = loadTunnelState(s.ID)
+	if err != nil {
+		return err
+	}
+	s.HandshakeSeconds = seconds
+	if err := saveTunnelState(s); err != nil {
+		return err
+	}
+	return updateMetrics(s.MetricsDir, func(m *metrics) {
+		m.observe(ikeHandshakeSeries, ikeHandshakeBuckets, seconds)
+	})
+}
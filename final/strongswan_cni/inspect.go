@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// What /tunnel reports about the tunnel of one pod, on top of /status: the
+// SAs charon has, from ipsec statusall, and its recent IKE errors. It's what
+// kubectl-ipsec shows.
+type tunnelInspection struct {
+	*tunnelStatus
+	IKE        []string         `json:"ike,omitempty"`
+	Children   []*childSAStatus `json:"children,omitempty"`
+	VirtualIPs []string         `json:"virtualIPs,omitempty"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+type childSAStatus struct {
+	Name   string   `json:"name"`
+	State  string   `json:"state"`
+	Local  []string `json:"local,omitempty"`
+	Remote []string `json:"remote,omitempty"`
+}
+
+var (
+	statusIKERegexp   = regexp.MustCompile(`^(\S+)\[\d+\]: (CREATED|CONNECTING|ESTABLISHED|PASSIVE|REKEYING|REKEYED|DELETING|DESTROYING)\b(.*)$`)
+	statusChildRegexp = regexp.MustCompile(`^(\S+)\{(\d+)\}:\s+([A-Z_]+),`)
+	statusTSRegexp    = regexp.MustCompile(`^(\S+)\{(\d+)\}:\s+(.+) === (.+)$`)
+	// Lines of the charon log reporting why a negotiation failed
+	ikeErrorRegexp = regexp.MustCompile(`failed|giving up|unable to|no acceptable|received [A-Z_]+ error notify|(NO_PROPOSAL_CHOSEN|AUTHENTICATION_FAILED|TS_UNACCEPTABLE|INVALID_[A-Z_]+)`)
+)
+
+// How many of the last IKE errors are reported, from how far back in the
+// charon log
+const (
+	inspectErrors  = 10
+	inspectLogTail = 256 * 1024
+)
+
+func serveTunnel(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status, _, err := loadStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var found *tunnelStatus
+	for _, s := range status {
+		if (q.Get("id") != "" && s.ID == q.Get("id")) ||
+			(q.Get("pod") != "" && s.Pod == q.Get("pod") && s.Namespace == q.Get("namespace")) {
+			found = s
+			break
+		}
+	}
+	if found == nil {
+		http.Error(w, "no tunnel for this pod on the node", http.StatusNotFound)
+		return
+	}
+
+	t := inspectTunnel(found)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func inspectTunnel(s *tunnelStatus) *tunnelInspection {
+	t := &tunnelInspection{tunnelStatus: s}
+	if charonRunning(s.ID) {
+		out, err := netnsCommand(s.ID, "ipsec", "statusall").CombinedOutput()
+		if err != nil {
+			t.Errors = append(t.Errors, "failed to get the status: "+err.Error()+": "+string(out))
+		} else {
+			t.parseStatus(string(out))
+		}
+	} else {
+		t.Errors = append(t.Errors, "charon isn't running")
+	}
+	t.Errors = append(recentIKEErrors(s.ID), t.Errors...)
+	return t
+}
+
+// Parse the Security Associations section of ipsec statusall
+func (t *tunnelInspection) parseStatus(out string) {
+	children := map[string]*childSAStatus{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if m := statusIKERegexp.FindStringSubmatch(line); m != nil {
+			t.IKE = append(t.IKE, m[1]+": "+m[2]+m[3])
+		} else if m := statusChildRegexp.FindStringSubmatch(line); m != nil {
+			c := &childSAStatus{Name: m[1] + "{" + m[2] + "}", State: m[3]}
+			children[c.Name] = c
+			t.Children = append(t.Children, c)
+		} else if m := statusTSRegexp.FindStringSubmatch(line); m != nil {
+			c := children[m[1]+"{"+m[2]+"}"]
+			if c == nil {
+				continue
+			}
+			c.Local, c.Remote = strings.Fields(m[3]), strings.Fields(m[4])
+		}
+	}
+	// With leftsourceip=%config, the local selectors are the virtual IPs
+	for _, c := range t.Children {
+		for _, ts := range c.Local {
+			ip, ipnet, err := net.ParseCIDR(ts)
+			if err != nil {
+				continue
+			}
+			if ones, bits := ipnet.Mask.Size(); ones == bits && !t.podIP(ip) && !contains(t.VirtualIPs, ip.String()) {
+				t.VirtualIPs = append(t.VirtualIPs, ip.String())
+			}
+		}
+	}
+}
+
+func (t *tunnelInspection) podIP(ip net.IP) bool {
+	for _, podIP := range t.IPs {
+		if podIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The last IKE errors in the charon log of the pod, which only exists with
+// auditLog
+func recentIKEErrors(id string) []string {
+	f, err := os.Open(charonLogPath(id))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if info, err := f.Stat(); err == nil && info.Size() > inspectLogTail {
+		f.Seek(-inspectLogTail, io.SeekEnd)
+		// Skip the partial line
+		scanner.Scan()
+	}
+
+	var errors []string
+	for scanner.Scan() {
+		if line := scanner.Text(); ikeErrorRegexp.MatchString(line) {
+			errors = append(errors, line)
+		}
+	}
+	if len(errors) > inspectErrors {
+		errors = errors[len(errors)-inspectErrors:]
+	}
+	return errors
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Latency of the ADD and DEL calls, as a whole and per phase, so slow pod
+// starts caused by the plugin show up in the metrics:
+// strongswan_cni_operation_duration_seconds{operation,result} and
+// strongswan_cni_operation_phase_duration_seconds{operation,phase}.
+const (
+	operationSeries      = "strongswan_cni_operation_duration_seconds"
+	operationPhaseSeries = "strongswan_cni_operation_phase_duration_seconds"
+)
+
+var operationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type operationTimer struct {
+	operation string
+	start     time.Time
+	last      time.Time
+	phases    []operationPhase
+}
+
+type operationPhase struct {
+	name    string
+	seconds float64
+}
+
+func newOperationTimer(operation string) *operationTimer {
+	now := time.Now()
+	return &operationTimer{operation: operation, start: now, last: now}
+}
+
+// Record the time since the previous phase ended as phase name
+func (t *operationTimer) phase(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, operationPhase{name, now.Sub(t.last).Seconds()})
+	t.last = now
+}
+
+// Add the operation and the phases it went through to the metrics, failures
+// are only logged
+func (t *operationTimer) record(metricsDir string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	total := time.Since(t.start).Seconds()
+
+	unlock, lockErr := lockState()
+	if lockErr != nil {
+		log.Println(logPrefix, "failed to record", t.operation, "latency:", lockErr)
+		return
+	}
+	defer unlock()
+	err = updateMetrics(metricsDir, func(m *metrics) {
+		m.observe(fmt.Sprintf(`%s{operation=%q,result=%q}`, operationSeries, t.operation, result), operationBuckets, total)
+		for _, p := range t.phases {
+			m.observe(fmt.Sprintf(`%s{operation=%q,phase=%q}`, operationPhaseSeries, t.operation, p.name), operationBuckets, p.seconds)
+		}
+	})
+	if err != nil {
+		log.Println(logPrefix, "failed to record", t.operation, "latency:", err)
+	}
+}
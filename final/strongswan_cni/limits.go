@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// What to do with a new pod once the node runs maxTunnels tunnels
+const (
+	limitPolicyReject = "reject"
+	limitPolicyEvict  = "evict"
+	limitPolicyQueue  = "queue"
+
+	tunnelQueueTimeout  = 60 * time.Second
+	tunnelQueueInterval = 2 * time.Second
+)
+
+func validateLimitPolicy(policy string) error {
+	switch policy {
+	case "", limitPolicyReject, limitPolicyEvict, limitPolicyQueue:
+		return nil
+	}
+	return fmt.Errorf("invalid tunnelLimitPolicy %q: must be %q, %q or %q", policy, limitPolicyReject, limitPolicyEvict, limitPolicyQueue)
+}
+
+// Record the tunnel of a new pod in the state store, enforcing the maximum
+// number of tunnels of the node. Hitting it is recorded as Events of the
+// pods, once the state lock is released.
+func reserveTunnel(n *NetConf, s *tunnelState) error {
+	var events []podEvent
+	defer func() { recordPodEvents(n, events) }()
+	queued := false
+	// When each tunnel was last used, looked up without the lock
+	var lastUsed map[string]time.Time
+	deadline := time.Now().Add(tunnelQueueTimeout)
+	for {
+		unlock, err := lockState()
+		if err != nil {
+			return err
+		}
+
+		states, err := loadTunnelStates()
+		if err != nil {
+			unlock()
+			return err
+		}
+
+		// One charon per namespace, so one tunnel per pod
+		for _, other := range states {
+			if other.ID == s.ID && other.Network != s.Network {
+				unlock()
+				return fmt.Errorf("pod already has a tunnel on network %q", other.Network)
+			}
+		}
+
+		if n.MaxTunnels > 0 && len(states) >= n.MaxTunnels {
+			switch n.TunnelLimitPolicy {
+			case limitPolicyEvict:
+				if lastUsed == nil {
+					unlock()
+					lastUsed = tunnelsLastUsed(states)
+					continue
+				}
+				victim := longestIdleTunnel(states, lastUsed)
+				log.Println(logPrefix, "tunnel limit reached, evicting idle tunnel of", victim.ContainerID)
+				evictTunnel(victim)
+				events = append(events, podEvent{victim.Namespace, victim.Pod, "TunnelEvicted",
+					fmt.Sprintf("IPsec tunnel evicted for %s/%s, the node reached maxTunnels %d; traffic is dropped until the pod is recreated", s.Namespace, s.Pod, n.MaxTunnels)})
+				if err := removeTunnelState(victim.ID); err != nil {
+					unlock()
+					return err
+				}
+				states = states[:len(states)-1]
+				updateMetrics(n.MetricsDir, func(m *metrics) {
+					m.inc(`strongswan_cni_tunnel_limit_total{action="evict"}`)
+				})
+
+			case limitPolicyQueue:
+				if time.Now().Before(deadline) {
+					updateMetrics(n.MetricsDir, func(m *metrics) {
+						m.inc(`strongswan_cni_tunnel_limit_total{action="queue"}`)
+					})
+					unlock()
+					if !queued {
+						queued = true
+						recordPodEvents(n, []podEvent{{s.Namespace, s.Pod, "TunnelLimitQueued",
+							fmt.Sprintf("Node reached maxTunnels %d, waiting up to %v for a free tunnel", n.MaxTunnels, tunnelQueueTimeout)}})
+					}
+					log.Println(logPrefix, "tunnel limit reached, waiting for a free slot for", s.ContainerID)
+					time.Sleep(tunnelQueueInterval)
+					continue
+				}
+				fallthrough
+
+			default:
+				updateMetrics(n.MetricsDir, func(m *metrics) {
+					m.inc(`strongswan_cni_tunnel_limit_total{action="reject"}`)
+				})
+				unlock()
+				events = append(events, podEvent{s.Namespace, s.Pod, "TunnelLimitReached",
+					fmt.Sprintf("Node reached maxTunnels %d, no IPsec tunnel for the pod", n.MaxTunnels)})
+				log.Println(logPrefix, "tunnel limit reached, rejecting", s.ContainerID)
+				return fmt.Errorf("node already runs the maximum of %d tunnels", n.MaxTunnels)
+			}
+		}
+
+		if err := allocateMark(s, states); err != nil {
+			unlock()
+			return err
+		}
+		if err := allocateZone(n, s, states); err != nil {
+			unlock()
+			return err
+		}
+		if err := saveTunnelState(s); err != nil {
+			unlock()
+			return err
+		}
+		err = updateMetrics(n.MetricsDir, func(m *metrics) {
+			m.set("strongswan_cni_tunnels", float64(len(states)+1))
+			m.set("strongswan_cni_tunnel_limit", float64(n.MaxTunnels))
+		})
+		unlock()
+		return err
+	}
+}
+
+// Tear down the tunnel of a pod to make room for another one. The host rules
+// are found from the state of the victim, its network may be set up
+// differently. Its pod keeps running, so it's failed closed rather than left
+// with plaintext connectivity.
+func evictTunnel(victim *tunnelState) {
+	teardownIpsec(victim.NetNS)
+	closeAudit(victim)
+	removeHostRules(victim)
+
+	netns, err := ns.GetNS(victim.NetNS)
+	if err != nil {
+		return
+	}
+	defer netns.Close()
+	if err := setupFailClosed(netns, victim.VPN); err != nil {
+		log.Println(logPrefix, "failed to fail", victim.ContainerID, "closed:", err)
+	}
+}
+
+// Forget about the tunnel of a deleted pod
+func releaseTunnel(n *NetConf, id string) error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := removeTunnelState(id); err != nil {
+		return err
+	}
+	states, err := loadTunnelStates()
+	if err != nil {
+		return err
+	}
+	if !anyPrioritizesIKE(states) {
+		if err := removeIKEPriority(); err != nil {
+			log.Println(logPrefix, "failed to remove IKE priority:", err)
+		}
+	}
+	return updateMetrics(n.MetricsDir, func(m *metrics) {
+		m.set("strongswan_cni_tunnels", float64(len(states)))
+	})
+}
+
+func anyPrioritizesIKE(states []*tunnelState) bool {
+	for _, s := range states {
+		if s.VPN.PrioritizeIKE {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the tunnel which carried no traffic for the longest time, from
+// lastUsed, or when it was created for the ones which came since. The victim
+// is moved to the end of states.
+func longestIdleTunnel(states []*tunnelState, lastUsed map[string]time.Time) *tunnelState {
+	used := func(s *tunnelState) time.Time {
+		if use, ok := lastUsed[s.ID]; ok {
+			return use
+		}
+		return s.Created
+	}
+	oldest := 0
+	oldestUse := used(states[0])
+	for i, s := range states[1:] {
+		if use := used(s); use.Before(oldestUse) {
+			oldest, oldestUse = i+1, use
+		}
+	}
+	last := len(states) - 1
+	states[oldest], states[last] = states[last], states[oldest]
+	return states[last]
+}
+
+// Run ip xfrm in every namespace, which the other ADDs needn't wait for
+func tunnelsLastUsed(states []*tunnelState) map[string]time.Time {
+	lastUsed := map[string]time.Time{}
+	for _, s := range states {
+		lastUsed[s.ID] = tunnelLastUsed(s)
+	}
+	return lastUsed
+}
+
+var xfrmUseRegexp = regexp.MustCompile(`use (\d{4}-\d\d-\d\d \d\d:\d\d:\d\d)`)
+
+// Last time an SA of the tunnel was used, according to the kernel. Tunnels
+// without any used SA count as idle since their creation.
+func tunnelLastUsed(s *tunnelState) time.Time {
+	last := s.Created
+	out, err := netnsCommand(s.ID, "ip", "-s", "xfrm", "state").Output()
+	if err != nil {
+		return last
+	}
+	for _, m := range xfrmUseRegexp.FindAllStringSubmatch(string(out), -1) {
+		use, err := time.ParseInLocation("2006-01-02 15:04:05", m[1], time.Local)
+		if err == nil && use.After(last) {
+			last = use
+		}
+	}
+	return last
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLongestIdleTunnel(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		created  []time.Duration
+		lastUsed map[string]time.Duration
+		victim   string
+	}{
+		{"single", []time.Duration{time.Hour}, nil, "0"},
+		{"never used", []time.Duration{time.Hour, 3 * time.Hour, 2 * time.Hour}, nil, "1"},
+		{
+			"used",
+			[]time.Duration{time.Hour, 3 * time.Hour, 2 * time.Hour},
+			map[string]time.Duration{"0": 10 * time.Minute, "1": time.Minute, "2": 30 * time.Minute},
+			"2",
+		},
+		// Created after the traffic was looked up
+		{
+			"created since",
+			[]time.Duration{time.Hour, 5 * time.Minute},
+			map[string]time.Duration{"0": time.Minute},
+			"1",
+		},
+	} {
+		var states []*tunnelState
+		for i, age := range tc.created {
+			states = append(states, &tunnelState{ID: string(rune('0' + i)), Created: now.Add(-age)})
+		}
+		lastUsed := map[string]time.Time{}
+		for id, idle := range tc.lastUsed {
+			lastUsed[id] = now.Add(-idle)
+		}
+		victim := longestIdleTunnel(states, lastUsed)
+		if victim.ID != tc.victim {
+			t.Errorf("%s: evicted %s, want %s", tc.name, victim.ID, tc.victim)
+		}
+		if last := states[len(states)-1]; last != victim {
+			t.Errorf("%s: %s was moved to the end instead of the victim", tc.name, last.ID)
+		}
+		if len(states) != len(tc.created) {
+			t.Errorf("%s: got %d states, want %d", tc.name, len(states), len(tc.created))
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+)
+
+// Make sure the pod has a loopback interface which is up and an IPv6
+// link-local address on ifName before charon starts: several strongSwan
+// plugins bind to them, and not every runtime sets them up. Must run in the
+// container namespace.
+func setupPodLinks(nsh *netlink.Handle, ifName string) error {
+	lo, err := nsh.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to lookup lo: %v", err)
+	}
+	if lo.Attrs().Flags&net.FlagUp == 0 {
+		if err := nsh.LinkSetUp(lo); err != nil {
+			return fmt.Errorf("failed to set lo up: %v", err)
+		}
+	}
+
+	if ipv6Disabled(ifName) {
+		return nil
+	}
+	link, err := nsh.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := nsh.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return fmt.Errorf("failed to get IPv6 addresses of %q: %v", ifName, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			return nil
+		}
+	}
+
+	// The kernel didn't generate one, eg: addr_gen_mode is none
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{IP: linkLocalAddr(link.Attrs().HardwareAddr), Mask: net.CIDRMask(64, 128)},
+		Flags: syscall.IFA_F_NODAD,
+	}
+	if err := nsh.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add link-local address to %q: %v", ifName, err)
+	}
+	return nil
+}
+
+func ipv6Disabled(ifName string) bool {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", ifName))
+	return err != nil || strings.TrimSpace(string(b)) == "1"
+}
+
+// EUI-64 link-local address of a MAC address
+func linkLocalAddr(mac net.HardwareAddr) net.IP {
+	return net.IP{0xfe, 0x80, 0, 0, 0, 0, 0, 0,
+		mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}
+}
+
+// Disable IPv6 in the pod, so no IPv6 traffic can bypass the tunnel. Must
+// run in the container namespace.
+func disablePodIPv6(ifName string) error {
+	for _, conf := range []string{"all", "default", ifName} {
+		f := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", conf)
+		if err := ioutil.WriteFile(f, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to disable IPv6: %v", err)
+		}
+	}
+	return nil
+}
+
+// Leave out the IPv6 addresses and routes of an IPAM result
+func dropIPv6(result *current.Result) {
+	var ips []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil {
+			ips = append(ips, ipc)
+		}
+	}
+	result.IPs = ips
+
+	var routes []*types.Route
+	for _, r := range result.Routes {
+		if r.Dst.IP.To4() != nil {
+			routes = append(routes, r)
+		}
+	}
+	result.Routes = routes
+}
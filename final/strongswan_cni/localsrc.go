@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+)
+
+// charon runs in the pod namespace, so the node address its IKE and ESP
+// packets leave from is picked by the host routing once they're masqueraded,
+// which on multi-homed nodes may not be the NIC meant for the VPN. With
+// localInterface or left, the traffic of the pod to serverIP is routed
+// through a table of its own holding a single route out of that interface,
+// and with left it's also SNATed to that address rather than to whichever
+// address of the interface the kernel prefers.
+const (
+	// Before the main table, priority 32766
+	localSourcePriority = 1300
+	// The table of an interface is this plus its index
+	localSourceTableBase = 1300
+)
+
+func validateLocalSource(vpnInfo vpnInfo) error {
+	if vpnInfo.Left == "" {
+		return nil
+	}
+	left := net.ParseIP(vpnInfo.Left)
+	if left == nil {
+		return fmt.Errorf("invalid left %q: expected an address of the node", vpnInfo.Left)
+	}
+	if server := net.ParseIP(vpnInfo.ServerIP); server != nil && (server.To4() == nil) != (left.To4() == nil) {
+		return fmt.Errorf("left %v and serverIP %v aren't of the same family", left, server)
+	}
+	return nil
+}
+
+// The interface of localInterface, or the one holding the left address
+func localSourceLink(h *netlink.Handle, vpnInfo vpnInfo) (netlink.Link, error) {
+	left := net.ParseIP(vpnInfo.Left)
+	if vpnInfo.LocalIface != "" {
+		link, err := h.LinkByName(vpnInfo.LocalIface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup localInterface %q: %v", vpnInfo.LocalIface, err)
+		}
+		if left == nil {
+			return link, nil
+		}
+		addrs, err := h.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %q: %v", vpnInfo.LocalIface, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(left) {
+				return link, nil
+			}
+		}
+		return nil, fmt.Errorf("left %v isn't an address of %q", left, vpnInfo.LocalIface)
+	}
+
+	links, err := h.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		addrs, err := h.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %q: %v", link.Attrs().Name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(left) {
+				return link, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("left %v isn't an address of the node", left)
+}
+
+// The route to the server out of the interface: through its default
+// gateway when it has one, on-link otherwise
+func localSourceRoute(h *netlink.Handle, link netlink.Link, server net.IP) (*netlink.Route, error) {
+	family, bits := netlink.FAMILY_V4, 32
+	if server.To4() == nil {
+		family, bits = netlink.FAMILY_V6, 128
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: server, Mask: net.CIDRMask(bits, bits)},
+		Table:     localSourceTableBase + link.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+	}
+	routes, err := h.RouteList(link, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes of %q: %v", link.Attrs().Name, err)
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Gw != nil {
+			route.Gw = r.Gw
+			route.Scope = netlink.SCOPE_UNIVERSE
+			break
+		}
+	}
+	return route, nil
+}
+
+func localSourceRule(ip, server net.IP, table int) *netlink.Rule {
+	bits := 32
+	if server.To4() == nil {
+		bits = 128
+	}
+	rule := netlink.NewRule()
+	rule.Priority = localSourcePriority
+	rule.Src = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	rule.Dst = &net.IPNet{IP: server, Mask: net.CIDRMask(bits, bits)}
+	rule.Table = table
+	return rule
+}
+
+func localSourceSNAT(s *tunnelState, ip net.IP) []string {
+	return []string{"-s", ip.String(), "-d", s.VPN.ServerIP, "-j", "SNAT", "--to-source", s.VPN.Left,
+		"-m", "comment", "--comment", fmt.Sprintf("strongswan-cni %s", s.ContainerID)}
+}
+
+// The pod addresses of the family of the server
+func localSourceIPs(s *tunnelState, server net.IP) []net.IP {
+	var ips []net.IP
+	for _, ip := range s.IPs {
+		if (ip.To4() == nil) == (server.To4() == nil) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Send the traffic of the pod to the server out of the chosen interface,
+// from the chosen address
+func setupLocalSource(h *netlink.Handle, s *tunnelState) error {
+	if s.VPN.LocalIface == "" && s.VPN.Left == "" {
+		return nil
+	}
+	server := net.ParseIP(s.VPN.ServerIP)
+	if server == nil {
+		return fmt.Errorf("invalid vpn serverIP %q", s.VPN.ServerIP)
+	}
+	link, err := localSourceLink(h, s.VPN)
+	if err != nil {
+		return err
+	}
+	route, err := localSourceRoute(h, link, server)
+	if err != nil {
+		return err
+	}
+	if err := h.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to add route to %v in table %d: %v", server, route.Table, err)
+	}
+
+	for _, ip := range localSourceIPs(s, server) {
+		if err := h.RuleAdd(localSourceRule(ip, server, route.Table)); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to add rule from %v to %v: %v", ip, server, err)
+		}
+		if s.VPN.Left == "" {
+			continue
+		}
+		// Ahead of the masquerading rules
+		ipt, err := markIPTables(ip)
+		if err != nil {
+			return err
+		}
+		exists, err := ipt.Exists("nat", "POSTROUTING", localSourceSNAT(s, ip)...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := ipt.Insert("nat", "POSTROUTING", 1, localSourceSNAT(s, ip)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete the rules of the pod whatever table they point to, the interface
+// may have been recreated with another index since. The table route is
+// shared by the pods and left in place.
+func removeLocalSource(s *tunnelState) error {
+	if s.VPN.LocalIface == "" && s.VPN.Left == "" {
+		return nil
+	}
+	server := net.ParseIP(s.VPN.ServerIP)
+	if server == nil {
+		return nil
+	}
+	family := netlink.FAMILY_V4
+	if server.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, ip := range localSourceIPs(s, server) {
+		want := localSourceRule(ip, server, 0)
+		for _, rule := range rules {
+			if rule.Priority != localSourcePriority || rule.Src == nil || rule.Dst == nil ||
+				rule.Src.String() != want.Src.String() || rule.Dst.String() != want.Dst.String() {
+				continue
+			}
+			want.Table = rule.Table
+			if err := netlink.RuleDel(want); err != nil {
+				return fmt.Errorf("failed to delete rule from %v to %v: %v", ip, server, err)
+			}
+		}
+		if s.VPN.Left == "" {
+			continue
+		}
+		ipt, err := markIPTables(ip)
+		if err != nil {
+			return err
+		}
+		exists, err := ipt.Exists("nat", "POSTROUTING", localSourceSNAT(s, ip)...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := ipt.Delete("nat", "POSTROUTING", localSourceSNAT(s, ip)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -20,8 +20,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"io/ioutil"
 
@@ -33,16 +37,41 @@ import (
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/containernetworking/plugins/pkg/utils/hwaddr"
 	"github.com/vishvananda/netlink"
+	nlns "github.com/vishvananda/netns"
 )
 
-const defaultBrName = "docker0"
-
 type vpnInfo struct {
 	ServerIP      string `json:"serverIP"`
 	VirtualSubnet string `json:"virtualSubnet"`
 	PSK           string `json:"psk"`
 	HostSubnet    string `json:"hostSubnet"`
+	DSCP          string `json:"dscp"`
+	PrioritizeIKE bool   `json:"prioritizeIKE"`
+	Inactivity    string `json:"inactivity"`
+	IKEVersion    string `json:"ikeVersion"`
+	IKELifetime   string `json:"ikeLifetime"`
+	KeyLifetime   string `json:"keyLifetime"`
+	KeepAlive     string `json:"keepAlive"`
+	IKEProposal   string `json:"ike"`
+	ESPProposal   string `json:"esp"`
+	Auth          string `json:"auth"`
+	NodeCACert    string `json:"nodeCACert"`
+	NodeCAKey     string `json:"nodeCAKey"`
+	CABundle      string `json:"caBundle"`
+	CertLifetime  string `json:"certLifetime"`
+	GatewayPin    string `json:"gatewayPin"`
+	GatewayCerts  string `json:"gatewayCerts"`
+	Left          string `json:"left"`
+	LocalIface    string `json:"localInterface"`
+	ForceDNS      bool   `json:"forceDNS"`
+	Connmark      bool   `json:"connmark"`
+	VRF           bool   `json:"vrf"`
+
+	MinStrength    *cryptoPolicy `json:"minStrength"`
+	PolicyPriority int           `json:"policyPriority"`
+	MarkMask       string        `json:"markMask"`
 }
 
 type NetConf struct {
@@ -56,6 +85,29 @@ type NetConf struct {
 	MTU          int     `json:"mtu"`
 	HairpinMode  bool    `json:"hairpinMode"`
 	PromiscMode  bool    `json:"promiscMode"`
+
+	MaxTunnels        int    `json:"maxTunnels"`
+	TunnelLimitPolicy string `json:"tunnelLimitPolicy"`
+	MetricsDir        string `json:"metricsDir"`
+	AuditLog          string `json:"auditLog"`
+	DisableIPv6       bool   `json:"disableIPv6"`
+	HostFirewall      string `json:"hostFirewall"`
+	Accounting        bool   `json:"accounting"`
+	ConntrackZones    bool   `json:"conntrackZones"`
+	EBPFStats         bool   `json:"ebpfStats"`
+	FastPath          bool   `json:"fastPath"`
+	Datapath          string `json:"datapath"`
+	CharonCPU         string `json:"charonCPU"`
+	CharonMemory      string `json:"charonMemory"`
+	Systemd           bool   `json:"systemd"`
+	EstablishQueue    bool   `json:"establishQueue"`
+	// error, warn or fail-closed
+	TunnelFailurePolicy string `json:"tunnelFailurePolicy"`
+	TunnelTimeout       string `json:"tunnelTimeout"`
+
+	ExcludeNamespaces []string `json:"excludeNamespaces"`
+	ExcludeLabels     []string `json:"excludeLabels"`
+	Kubeconfig        string   `json:"kubeconfig"`
 }
 
 type gwInfo struct {
@@ -72,15 +124,83 @@ func init() {
 }
 
 func loadNetConf(bytes []byte) (*NetConf, string, error) {
-	n := &NetConf{
-		BrName: defaultBrName,
-	}
+	n := &NetConf{}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if n.BrName == "" {
+		n.BrName = networkBridgeName(n.Name)
+	}
+	if err := validateVPN(n.VPN); err != nil {
+		return nil, "", err
+	}
+	if err := validateLimitPolicy(n.TunnelLimitPolicy); err != nil {
+		return nil, "", err
+	}
+	if err := validateHostFirewall(n.HostFirewall); err != nil {
+		return nil, "", err
+	}
+	if err := validateDatapath(n.Datapath); err != nil {
+		return nil, "", err
+	}
+	if err := validateCharonLimits(n); err != nil {
+		return nil, "", err
+	}
+	if err := validateRootlessDir(); err != nil {
+		return nil, "", err
+	}
+	if err := validateCharonUnit(n); err != nil {
+		return nil, "", err
+	}
+	if err := validateFailurePolicy(n); err != nil {
+		return nil, "", err
+	}
 	return n, n.CNIVersion, nil
 }
 
+// Validate the settings of the vpn object, when the config is loaded and
+// when the tunnel of a pod is updated
+func validateVPN(vpnInfo vpnInfo) error {
+	if _, _, err := parseDSCP(vpnInfo.DSCP); err != nil {
+		return err
+	}
+	for name, value := range map[string]string{
+		"inactivity":  vpnInfo.Inactivity,
+		"ikeLifetime": vpnInfo.IKELifetime,
+		"keyLifetime": vpnInfo.KeyLifetime,
+		"keepAlive":   vpnInfo.KeepAlive,
+	} {
+		if err := validateIpsecTime(name, value); err != nil {
+			return err
+		}
+	}
+	if err := validateIKEVersion(vpnInfo); err != nil {
+		return err
+	}
+	if err := validateAuth(vpnInfo); err != nil {
+		return err
+	}
+	if err := validateGatewayPin(vpnInfo); err != nil {
+		return err
+	}
+	if err := validateLocalSource(vpnInfo); err != nil {
+		return err
+	}
+	if err := validateCryptoPolicy(vpnInfo); err != nil {
+		return err
+	}
+	if err := validateMarkMask(vpnInfo); err != nil {
+		return err
+	}
+	if err := validateConnmark(vpnInfo); err != nil {
+		return err
+	}
+	if vpnInfo.PolicyPriority < 0 {
+		return fmt.Errorf("invalid policyPriority %d: must be positive", vpnInfo.PolicyPriority)
+	}
+	return nil
+}
+
 // calcGateways processes the results from the IPAM plugin and does the
 // following for each IP family:
 //    - Calculates and compiles a list of gateway addresses
@@ -148,18 +268,32 @@ func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error)
 	return gwsV4, gwsV6, nil
 }
 
-func ensureBridgeAddr(br *netlink.Bridge, family int, ipn *net.IPNet, forceAddress bool) error {
-	addrs, err := netlink.AddrList(br, family)
+// Ensure the bridge has the gateway addresses of one IP family, listing its
+// current addresses only once
+func ensureBridgeAddrs(h *netlink.Handle, br *netlink.Bridge, family int, gws []net.IPNet, forceAddress bool) error {
+	addrs, err := h.AddrList(br, family)
 	if err != nil && err != syscall.ENOENT {
 		return fmt.Errorf("could not get list of IP addresses: %v", err)
 	}
 
+	for i := range gws {
+		ipn := &gws[i]
+		if addrs, err = ensureBridgeAddr(h, br, family, addrs, ipn, forceAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add ipn to the bridge unless it's in addrs, returns the updated addrs
+func ensureBridgeAddr(h *netlink.Handle, br *netlink.Bridge, family int, addrs []netlink.Addr, ipn *net.IPNet, forceAddress bool) ([]netlink.Addr, error) {
 	ipnStr := ipn.String()
+	kept := addrs[:0:0]
 	for _, a := range addrs {
 
 		// string comp is actually easiest for doing IPNet comps
 		if a.IPNet.String() == ipnStr {
-			return nil
+			return addrs, nil
 		}
 
 		// Multiple IPv6 addresses are allowed on the bridge if the
@@ -167,35 +301,101 @@ func ensureBridgeAddr(br *netlink.Bridge, family int, ipn *net.IPNet, forceAddre
 		// overlapping IPv6 subnets, reconfigure the IP address if
 		// forceAddress is true, otherwise throw an error.
 		if family == netlink.FAMILY_V4 || a.IPNet.Contains(ipn.IP) || ipn.Contains(a.IPNet.IP) {
-			if forceAddress {
-				if err = deleteBridgeAddr(br, a.IPNet); err != nil {
-					return err
-				}
-			} else {
-				return fmt.Errorf("%q already has an IP address different from %v", br.Name, ipnStr)
+			if !forceAddress {
+				return nil, fmt.Errorf("%q already has an IP address different from %v", br.Name, ipnStr)
+			}
+			if err := deleteBridgeAddr(h, br, a.IPNet); err != nil {
+				return nil, err
 			}
+			continue
 		}
+		kept = append(kept, a)
 	}
 
 	addr := &netlink.Addr{IPNet: ipn, Label: ""}
-	if err := netlink.AddrAdd(br, addr); err != nil {
-		return fmt.Errorf("could not add IP address to %q: %v", br.Name, err)
+	if err := h.AddrAdd(br, addr); err != nil {
+		return nil, fmt.Errorf("could not add IP address to %q: %v", br.Name, err)
 	}
-	return nil
+	return append(kept, *addr), nil
+}
+
+// Set the gateway addresses on the bridge and enable forwarding for each IP
+// family. Families are independent, so dual-stack networks configure them
+// concurrently: the first family uses h, the others their own handle since a
+// handle can't be shared between goroutines. All errors are reported.
+func configureGateways(h *netlink.Handle, br *netlink.Bridge, forceAddress bool, families ...*gwInfo) error {
+	configure := func(h *netlink.Handle, gws *gwInfo) error {
+		if err := ensureBridgeAddrs(h, br, gws.family, gws.gws, forceAddress); err != nil {
+			return fmt.Errorf("failed to set bridge addr: %v", err)
+		}
+		if err := enableIPForward(gws.family); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+		return nil
+	}
+
+	var pending []*gwInfo
+	for _, gws := range families {
+		if gws.gws != nil {
+			pending = append(pending, gws)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	for i, gws := range pending[1:] {
+		wg.Add(1)
+		go func(i int, gws *gwInfo) {
+			defer wg.Done()
+			h, err := netlink.NewHandle()
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to open netlink handle: %v", err)
+				return
+			}
+			defer h.Delete()
+			errs[i] = configure(h, gws)
+		}(i+1, gws)
+	}
+	errs[0] = configure(h, pending[0])
+	wg.Wait()
+
+	return joinErrors(errs)
 }
 
-func deleteBridgeAddr(br *netlink.Bridge, ipn *net.IPNet) error {
+// Combine the non-nil errors into one, nil if there are none
+func joinErrors(errs []error) error {
+	var failed []error
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+			msgs = append(msgs, err.Error())
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+func deleteBridgeAddr(h *netlink.Handle, br *netlink.Bridge, ipn *net.IPNet) error {
 	addr := &netlink.Addr{IPNet: ipn, Label: ""}
 
-	if err := netlink.AddrDel(br, addr); err != nil {
+	if err := h.AddrDel(br, addr); err != nil {
 		return fmt.Errorf("could not remove IP address from %q: %v", br.Name, err)
 	}
 
 	return nil
 }
 
-func bridgeByName(name string) (*netlink.Bridge, error) {
-	l, err := netlink.LinkByName(name)
+func bridgeByName(h *netlink.Handle, name string) (*netlink.Bridge, error) {
+	l, err := h.LinkByName(name)
 	if err != nil {
 		return nil, fmt.Errorf("could not lookup %q: %v", name, err)
 	}
@@ -206,7 +406,7 @@ func bridgeByName(name string) (*netlink.Bridge, error) {
 	return br, nil
 }
 
-func ensureBridge(brName string, mtu int, promiscMode bool) (*netlink.Bridge, error) {
+func ensureBridge(h *netlink.Handle, brName string, mtu int, promiscMode bool) (*netlink.Bridge, error) {
 	br := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: brName,
@@ -219,32 +419,49 @@ func ensureBridge(brName string, mtu int, promiscMode bool) (*netlink.Bridge, er
 		},
 	}
 
-	err := netlink.LinkAdd(br)
+	err := h.LinkAdd(br)
 	if err != nil && err != syscall.EEXIST {
 		return nil, fmt.Errorf("could not add %q: %v", brName, err)
 	}
 
 	if promiscMode {
-		if err := netlink.SetPromiscOn(br); err != nil {
+		if err := h.SetPromiscOn(br); err != nil {
 			return nil, fmt.Errorf("could not set promiscuous mode on %q: %v", brName, err)
 		}
 	}
 
 	// Re-fetch link to read all attributes and if it already existed,
 	// ensure it's really a bridge with similar configuration
-	br, err = bridgeByName(brName)
+	br, err = bridgeByName(h, brName)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := netlink.LinkSetUp(br); err != nil {
-		return nil, err
+	// On busy nodes the bridge is almost always up already
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		if err := h.LinkSetUp(br); err != nil {
+			return nil, err
+		}
 	}
 
 	return br, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool) (*current.Interface, *current.Interface, error) {
+// Set the hardware address of link from its IPv4 address, like
+// ip.SetHWAddrByIP but without looking the link up again. Returns the new
+// address so callers don't need to re-fetch the link.
+func setHWAddrByIP(h *netlink.Handle, link netlink.Link, ip4 net.IP) (net.HardwareAddr, error) {
+	hwAddr, err := hwaddr.GenerateHardwareAddr4(ip4, hwaddr.PrivateMACPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate hardware addr: %v", err)
+	}
+	if err := h.LinkSetHardwareAddr(link, hwAddr); err != nil {
+		return nil, fmt.Errorf("failed to add hardware addr to %q: %v", link.Attrs().Name, err)
+	}
+	return hwAddr, nil
+}
+
+func setupVeth(h *netlink.Handle, netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool) (*current.Interface, *current.Interface, error) {
 	contIface := &current.Interface{}
 	hostIface := &current.Interface{}
 
@@ -265,19 +482,24 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 	}
 
 	// need to lookup hostVeth again as its index has changed during ns move
-	hostVeth, err := netlink.LinkByName(hostIface.Name)
+	hostVeth, err := h.LinkByName(hostIface.Name)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
 	}
 	hostIface.Mac = hostVeth.Attrs().HardwareAddr.String()
 
+	// in routed mode, the host veth stays on its own
+	if br == nil {
+		return hostIface, contIface, nil
+	}
+
 	// connect host veth end to the bridge
-	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
+	if err := h.LinkSetMaster(hostVeth, br); err != nil {
 		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
 	}
 
 	// set hairpin mode
-	if err = netlink.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
+	if err = h.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
 		return nil, nil, fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVeth.Attrs().Name, err)
 	}
 
@@ -289,9 +511,9 @@ func calcGatewayIP(ipn *net.IPNet) net.IP {
 	return ip.NextIP(nid)
 }
 
-func setupBridge(n *NetConf) (*netlink.Bridge, *current.Interface, error) {
+func setupBridge(h *netlink.Handle, n *NetConf) (*netlink.Bridge, *current.Interface, error) {
 	// create bridge if necessary
-	br, err := ensureBridge(n.BrName, n.MTU, n.PromiscMode)
+	br, err := ensureBridge(h, n.BrName, n.MTU, n.PromiscMode)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
 	}
@@ -317,12 +539,14 @@ func enableIPForward(family int) error {
 }
 
 // Main entry point for CNI to add and configure interface
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	n, cniVersion, err := loadNetConf(args.StdinData)
 
 	if err != nil {
 		return err
 	}
+	timer := newOperationTimer("add")
+	defer func() { timer.record(n.MetricsDir, err) }()
 
 	if n.IsDefaultGW {
 		n.IsGW = true
@@ -332,10 +556,32 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("cannot set hairpin mode and promiscous mode at the same time.")
 	}
 
-	br, brInterface, err := setupBridge(n)
+	// Share netlink sockets between all operations of this invocation,
+	// in the host and in the container namespace
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return fmt.Errorf("failed to open netlink handle: %v", err)
+	}
+	defer h.Delete()
+
+	// The sandbox may already be set up, eg: when only its containers
+	// restarted
+	prev, reattached, err := reattachTunnel(h, args, n)
 	if err != nil {
 		return err
 	}
+	if reattached {
+		return types.PrintResult(prev, cniVersion)
+	}
+
+	routed := n.Datapath == datapathRouted
+	var br *netlink.Bridge
+	var brInterface *current.Interface
+	if !routed {
+		if br, brInterface, err = setupBridge(h, n); err != nil {
+			return err
+		}
+	}
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -343,16 +589,24 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode)
+	nsh, err := netlink.NewHandleAt(nlns.NsHandle(netns.Fd()))
+	if err != nil {
+		return fmt.Errorf("failed to open netlink handle in %q: %v", args.Netns, err)
+	}
+	defer nsh.Delete()
+
+	hostInterface, containerInterface, err := setupVeth(h, netns, br, args.IfName, n.MTU, n.HairpinMode)
 	if err != nil {
 		return err
 	}
+	timer.phase("links")
 
 	// run the IPAM plugin and get back the config to apply
 	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
 	if err != nil {
 		return err
 	}
+	timer.phase("ipam")
 
 	// Convert whatever the IPAM result was into the current Result type
 	result, err := current.NewResultFromResult(r)
@@ -364,12 +618,31 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return errors.New("IPAM plugin returned missing IP config")
 	}
 
-	result.Interfaces = []*current.Interface{brInterface, hostInterface, containerInterface}
+	if n.DisableIPv6 {
+		dropIPv6(result)
+		if len(result.IPs) == 0 {
+			return errors.New("IPAM plugin returned no IPv4 config and disableIPv6 is set")
+		}
+	}
 
-	// Gather gateway information for each IP family
-	gwsV4, gwsV6, err := calcGateways(result, n)
-	if err != nil {
-		return err
+	// Pods of the IPAM subnets aren't masqueraded, even once routed mode
+	// turned their addresses into host addresses
+	var masqNets []*net.IPNet
+	for _, ipc := range result.IPs {
+		masqNets = append(masqNets, ip.Network(&ipc.Address))
+	}
+
+	// Gather gateway information for each IP family, the host is the
+	// gateway of every pod in routed mode
+	var gwsV4, gwsV6 *gwInfo
+	if routed {
+		result.Interfaces = []*current.Interface{hostInterface, containerInterface}
+		routeResult(result)
+	} else {
+		result.Interfaces = []*current.Interface{brInterface, hostInterface, containerInterface}
+		if gwsV4, gwsV6, err = calcGateways(result, n); err != nil {
+			return err
+		}
 	}
 
 	// Configure the container hardware address and IP address(es)
@@ -379,56 +652,64 @@ func cmdAdd(args *skel.CmdArgs) error {
 		// packets, which causes DAD failures.
 		// TODO: (short term) Disable DAD conditional on actual hairpin mode
 		// TODO: (long term) Use enhanced DAD when that becomes available in kernels.
-		if err := disableIPV6DAD(args.IfName); err != nil {
+		if n.DisableIPv6 {
+			if err := disablePodIPv6(args.IfName); err != nil {
+				return err
+			}
+		} else if err := disableIPV6DAD(args.IfName); err != nil {
 			return err
 		}
 
-		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+		if err := configureIface(nsh, args.IfName, result); err != nil {
 			return err
 		}
 
+		// The MAC address only changes when it's derived from the IPv4
+		// address, which saves re-fetching the veth otherwise
 		if result.IPs[0].Address.IP.To4() != nil {
-			if err := ip.SetHWAddrByIP(args.IfName, result.IPs[0].Address.IP, nil /* TODO IPv6 */); err != nil {
+			link, err := nsh.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("could not lookup %q: %v", args.IfName, err)
+			}
+			hwAddr, err := setHWAddrByIP(nsh, link, result.IPs[0].Address.IP)
+			if err != nil {
 				return err
 			}
+			containerInterface.Mac = hwAddr.String()
 		}
 
-		// Refetch the veth since its MAC address may changed
-		link, err := netlink.LinkByName(args.IfName)
-		if err != nil {
-			return fmt.Errorf("could not lookup %q: %v", args.IfName, err)
+		if err := setupPodLinks(nsh, args.IfName); err != nil {
+			return err
 		}
-		containerInterface.Mac = link.Attrs().HardwareAddr.String()
+
+		announceAddrs(args.IfName, result)
 
 		return nil
 	}); err != nil {
 		return err
 	}
 
-	if n.IsGW {
+	// The bridge MAC address is known once it's derived from the gateway
+	// address, else refetch the bridge since its MAC address may change
+	// when the first veth is added
+	var brHWAddr net.HardwareAddr
+	if routed {
+		if err = setupHostRoutes(h, hostInterface.Name, result); err != nil {
+			return err
+		}
+	} else if n.IsGW {
 		var firstV4Addr net.IP
-		// Set the IP address(es) on the bridge and enable forwarding
-		for _, gws := range []*gwInfo{gwsV4, gwsV6} {
-			for _, gw := range gws.gws {
-				if gw.IP.To4() != nil && firstV4Addr == nil {
-					firstV4Addr = gw.IP
-				}
-
-				err = ensureBridgeAddr(br, gws.family, &gw, n.ForceAddress)
-				if err != nil {
-					return fmt.Errorf("failed to set bridge addr: %v", err)
-				}
-			}
+		if gwsV4.gws != nil {
+			firstV4Addr = gwsV4.gws[0].IP
+		}
 
-			if gws.gws != nil {
-				if err = enableIPForward(gws.family); err != nil {
-					return fmt.Errorf("failed to enable forwarding: %v", err)
-				}
-			}
+		// Set the IP address(es) on the bridge and enable forwarding
+		if err = configureGateways(h, br, n.ForceAddress, gwsV4, gwsV6); err != nil {
+			return err
 		}
 
 		if firstV4Addr != nil {
-			if err := ip.SetHWAddrByIP(n.BrName, firstV4Addr, nil /* TODO IPv6 */); err != nil {
+			if brHWAddr, err = setHWAddrByIP(h, br, firstV4Addr); err != nil {
 				return err
 			}
 		}
@@ -437,41 +718,201 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if n.IPMasq {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
-		for _, ipc := range result.IPs {
-			if err = ip.SetupIPMasq(ip.Network(&ipc.Address), chain, comment); err != nil {
+		for _, ipn := range masqNets {
+			if err = setupIPMasq(ipn, chain, comment); err != nil {
 				return err
 			}
 		}
 	}
 
-	// Refetch the bridge since its MAC address may change when the first
-	// veth is added or after its IP address is set
-	br, err = bridgeByName(n.BrName)
-	if err != nil {
-		return err
+	if brInterface != nil {
+		if brHWAddr == nil {
+			if br, err = bridgeByName(h, n.BrName); err != nil {
+				return err
+			}
+			brHWAddr = br.Attrs().HardwareAddr
+		}
+		brInterface.Mac = brHWAddr.String()
 	}
-	brInterface.Mac = br.Attrs().HardwareAddr.String()
 
 	result.DNS = n.DNS
+	timer.phase("netns")
 
-	// Bring up strongSwan
-	if err = establishIpsec(args.Netns, args.ContainerID, n.VPN); err != nil {
-		log.Println("strongswan", "failed to establish ipsec connection: %v", err)
+	if excludedPod(n, args.Args) {
+		return types.PrintResult(result, cniVersion)
+	}
+	// One charon per namespace: another network of the plugin attached to
+	// the pod only gets plain networking
+	if other, err := loadTunnelState(extractProcId(args.Netns)); err == nil && other.Network != n.Name {
+		log.Println(logPrefix, "pod", args.ContainerID, "already has a tunnel on network", other.Network+", not setting one up on", n.Name)
+		return types.PrintResult(result, cniVersion)
+	}
+	if err = setupTunnel(h, args, n, netns, result); err != nil {
 		return err
 	}
+	timer.phase("ipsec")
 
 	return types.PrintResult(result, cniVersion)
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+// Bring up the IPSec tunnel of a pod whose network is configured
+func setupTunnel(h *netlink.Handle, args *skel.CmdArgs, n *NetConf, netns ns.NetNS, result *current.Result) error {
+	id := extractProcId(args.Netns)
+	s := &tunnelState{
+		ID:          id,
+		ContainerID: args.ContainerID,
+		NetNS:       args.Netns,
+		Network:     n.Name,
+		VPN:         n.VPN,
+		AuditLog:    n.AuditLog,
+		MetricsDir:  n.MetricsDir,
+		Created:     time.Now(),
+		Systemd:     n.Systemd,
+	}
+	s.Namespace, s.Pod = parseK8sArgs(args.Args)
+	s.CharonLimits = newCharonLimits(n, s, k8sArg(args.Args, "K8S_POD_UID"))
+	if n.Datapath != datapathRouted {
+		s.Bridge = n.BrName
+	}
+	var podMAC string
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox != "" {
+			podMAC = iface.Mac
+		} else if iface.Name != n.BrName {
+			s.HostVeth = iface.Name
+		}
+	}
+	for _, ipc := range result.IPs {
+		s.IPs = append(s.IPs, ipc.Address.IP)
+	}
+	err := reserveTunnel(n, s)
+	if err != nil {
+		return err
+	}
+
+	if err = setupDSCP(netns, n.VPN); err != nil {
+		releaseTunnel(n, id)
+		return err
+	}
+
+	if err = setupForcedDNS(netns, n.VPN); err != nil {
+		releaseTunnel(n, id)
+		return err
+	}
+
+	if err = setupVRF(netns, n.VPN, args.IfName); err != nil {
+		releaseTunnel(n, id)
+		return err
+	}
+
+	if failurePolicy(n) == failurePolicyFailClosed {
+		if err = setupFailClosed(netns, n.VPN); err != nil {
+			releaseTunnel(n, id)
+			return err
+		}
+	}
+
+	if n.VPN.PrioritizeIKE {
+		if err = prioritizeIKE(h, n.VPN.ServerIP); err != nil {
+			releaseTunnel(n, id)
+			return fmt.Errorf("failed to prioritize IKE traffic: %v", err)
+		}
+	}
+
+	// Host rules of the pod, undone all at once on failure
+	for _, setup := range []struct {
+		what string
+		fn   func() error
+	}{
+		{"open host firewall", func() error { return openHostFirewall(n, s) }},
+		{"route IKE from the local interface", func() error { return setupLocalSource(h, s) }},
+		{"mark pod traffic", func() error { return markPodTraffic(s) }},
+		{"start accounting", func() error { return startAccounting(n, s) }},
+		{"set up conntrack zone", func() error { return setupConntrackZone(s) }},
+		{"attach eBPF stats", func() error {
+			if !n.EBPFStats {
+				return nil
+			}
+			return attachBPFStats(h, s)
+		}},
+		{"set up fast path", func() error {
+			// Routed mode redirects between local pods with it
+			if !n.FastPath && n.Datapath != datapathRouted {
+				return nil
+			}
+			return setupFastPath(h, s, podMAC)
+		}},
+	} {
+		if err = setup.fn(); err != nil {
+			removeHostRules(s)
+			releaseTunnel(n, id)
+			return fmt.Errorf("failed to %s: %v", setup.what, err)
+		}
+	}
+
+	// Bring up strongSwan, or let the daemon do it
+	if n.EstablishQueue && queueServed() {
+		if err = configureIpsec(s); err == nil {
+			err = enqueueTunnel(id)
+		}
+	} else if err = establishIpsec(s); err == nil && failurePolicy(n) == failurePolicyError {
+		err = waitForTunnel(s, n.TunnelTimeout)
+	}
+	if err != nil && failurePolicy(n) != failurePolicyError {
+		tunnelFailed(n, s, err)
+		return nil
+	}
+	if err != nil {
+		log.Println(logPrefix, "failed to establish ipsec connection:", err)
+		teardownIpsec(s.NetNS)
+		removeHostRules(s)
+		releaseTunnel(n, id)
+		return err
+	}
+	return nil
+}
+
+// Remove the rules set up on the host for the tunnel of a pod, failures are
+// only logged
+func removeHostRules(s *tunnelState) {
+	if err := closeHostFirewall(s); err != nil {
+		log.Println(logPrefix, "failed to remove host firewall rules:", err)
+	}
+	if err := removeLocalSource(s); err != nil {
+		log.Println(logPrefix, "failed to remove local source rules:", err)
+	}
+	if err := unmarkPodTraffic(s); err != nil {
+		log.Println(logPrefix, "failed to remove mark rules:", err)
+	}
+	if err := stopAccounting(s); err != nil {
+		log.Println(logPrefix, "failed to remove accounting rules:", err)
+	}
+	if err := teardownConntrackZone(s); err != nil {
+		log.Println(logPrefix, "failed to remove conntrack zone rules:", err)
+	}
+	if err := detachBPFStats(s); err != nil {
+		log.Println(logPrefix, "failed to remove eBPF stats:", err)
+	}
+	if err := removeFastPath(s); err != nil {
+		log.Println(logPrefix, "failed to remove fast path entries:", err)
+	}
+	if err := removeCharonCgroup(s); err != nil {
+		log.Println(logPrefix, "failed to remove charon cgroup:", err)
+	}
+}
+
+func cmdDel(args *skel.CmdArgs) (err error) {
 	n, _, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
+	timer := newOperationTimer("del")
+	defer func() { timer.record(n.MetricsDir, err) }()
 
 	if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
 		return err
 	}
+	timer.phase("ipam")
 
 	if args.Netns == "" {
 		return nil
@@ -479,33 +920,59 @@ func cmdDel(args *skel.CmdArgs) error {
 
 	// There is a netns so try to clean up. Delete can be called multiple times
 	// First, let bring down the ipsec
-	teardownIpsec(args.Netns)
+	id := extractProcId(args.Netns)
+	s, err := loadTunnelState(id)
+	if err == nil && s.Network != n.Name {
+		// The tunnel of the pod belongs to another network of the plugin
+		log.Println(logPrefix, "leaving the tunnel of", s.ContainerID, "to network", s.Network)
+	} else {
+		dequeueTunnel(id)
+		teardownIpsec(args.Netns)
+		if err == nil {
+			// The audit command may be flushing the same log
+			unlock, err := lockState()
+			if err != nil {
+				return err
+			}
+			err = closeAudit(s)
+			unlock()
+			if err != nil {
+				log.Println(logPrefix, "failed to flush audit records:", err)
+			}
+		} else {
+			// Without its state, only the rules named after the container
+			// can be found
+			s = &tunnelState{ID: id, ContainerID: args.ContainerID, Network: n.Name, VPN: n.VPN}
+		}
+		removeHostRules(s)
+		if err := releaseTunnel(n, id); err != nil {
+			return err
+		}
+	}
+	timer.phase("ipsec")
 
 	// so don't return an error if the device is already removed.
 	// If the device isn't there then don't try to clean up IP masq either	.
-	var ipn *net.IPNet
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		var err error
-		ipn, err = ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_ALL)
-		if err != nil && err == ip.ErrLinkNotFound {
-			return nil
-		}
-		return err
-	})
-
+	ipns, err := delContainerLink(args.Netns, args.IfName)
 	if err != nil {
 		return err
 	}
 
-	if ipn != nil && n.IPMasq {
+	if len(ipns) > 0 && n.IPMasq {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
-		err = ip.TeardownIPMasq(ipn, chain, comment)
+		err = teardownIPMasq(masqNetworks(ipns, chain), chain, comment)
+	}
+	if err == nil {
+		timer.phase("netns")
 	}
 
 	return err
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	skel.PluginMain(cmdAdd, cmdDel, version.All)
 }
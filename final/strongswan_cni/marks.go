@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const markChain = "STRONGSWAN-MARK"
+
+// Every pod gets its own value within markMask. charon sets it on the
+// packets of the pod SAs, as set_mark_in/set_mark_out, but marks don't
+// survive the veth, so the host marks the packets from and to the pod
+// addresses too: before routing for the traffic of the pod, so it can be
+// policy-routed, and when forwarding for the traffic towards the pod.
+func parseMarkMask(markMask string) (uint32, error) {
+	mask, err := strconv.ParseUint(markMask, 0, 32)
+	if err != nil || mask == 0 {
+		return 0, fmt.Errorf("invalid markMask %q", markMask)
+	}
+	// Pods are numbered within the mask, its bits must be contiguous
+	shifted := mask >> uint(bits.TrailingZeros32(uint32(mask)))
+	if shifted&(shifted+1) != 0 {
+		return 0, fmt.Errorf("invalid markMask %q: bits must be contiguous", markMask)
+	}
+	return uint32(mask), nil
+}
+
+func validateMarkMask(vpnInfo vpnInfo) error {
+	if vpnInfo.MarkMask == "" {
+		return nil
+	}
+	_, err := parseMarkMask(vpnInfo.MarkMask)
+	return err
+}
+
+// Pick the lowest mark not used by another tunnel. The caller holds the
+// state lock.
+func allocateMark(s *tunnelState, states []*tunnelState) error {
+	if s.VPN.MarkMask == "" {
+		return nil
+	}
+	mask, err := parseMarkMask(s.VPN.MarkMask)
+	if err != nil {
+		return err
+	}
+
+	used := make(map[uint32]bool)
+	for _, other := range states {
+		used[other.Mark] = true
+	}
+	shift := uint(bits.TrailingZeros32(mask))
+	for i := uint32(1); i <= mask>>shift; i++ {
+		if mark := i << shift; !used[mark] {
+			s.Mark = mark
+			return nil
+		}
+	}
+	return fmt.Errorf("no free mark left in markMask %s", s.VPN.MarkMask)
+}
+
+func markRules(s *tunnelState, ip net.IP) [][]string {
+	mark := fmt.Sprintf("%#x/%s", s.Mark, s.VPN.MarkMask)
+	comment := fmt.Sprintf("strongswan-cni %s", s.ContainerID)
+	return [][]string{
+		{"-s", ip.String(), "-j", "MARK", "--set-xmark", mark, "-m", "comment", "--comment", comment},
+		{"-d", ip.String(), "-j", "MARK", "--set-xmark", mark, "-m", "comment", "--comment", comment},
+	}
+}
+
+func markIPTables(ip net.IP) (*iptables.IPTables, error) {
+	proto := iptables.ProtocolIPv4
+	if ip.To4() == nil {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	return ipt, nil
+}
+
+// Mark the traffic of the pod on the host
+func markPodTraffic(s *tunnelState) error {
+	if s.Mark == 0 {
+		return nil
+	}
+	for _, ip := range s.IPs {
+		ipt, err := markIPTables(ip)
+		if err != nil {
+			return err
+		}
+		if err := ensureChain(ipt, "mangle", markChain); err != nil {
+			return err
+		}
+		for _, hook := range []string{"PREROUTING", "FORWARD"} {
+			if err := ipt.AppendUnique("mangle", hook, "-j", markChain); err != nil {
+				return err
+			}
+		}
+		for _, rule := range markRules(s, ip) {
+			if err := ipt.AppendUnique("mangle", markChain, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func unmarkPodTraffic(s *tunnelState) error {
+	if s.Mark == 0 {
+		return nil
+	}
+	for _, ip := range s.IPs {
+		ipt, err := markIPTables(ip)
+		if err != nil {
+			return err
+		}
+		for _, rule := range markRules(s, ip) {
+			exists, err := ipt.Exists("mangle", markChain, rule...)
+			if err != nil {
+				return err
+			}
+			if exists {
+				if err := ipt.Delete("mangle", markChain, rule...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// DEL used to only tear down the masquerading of the first address of the
+// pod, so the IPv6 rules of dual-stack pods were left behind. The rules of
+// every address are removed here, with iptables or ip6tables by family, the
+// same rules ip.SetupIPMasq adds.
+
+// Delete the container interface, returning its global addresses
+func delContainerLink(netns, ifName string) ([]*net.IPNet, error) {
+	var ipns []*net.IPNet
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ipns = append(ipns, addr.IPNet)
+		}
+
+		if err = netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", ifName, err)
+		}
+		return nil
+	})
+	return ipns, err
+}
+
+// Masquerade the traffic of a pod address, with firewalld direct rules when
+// firewalld manages the node
+func setupIPMasq(ipn *net.IPNet, chain, comment string) error {
+	fw, err := connectFirewalld()
+	if err != nil {
+		return err
+	}
+	if fw != nil {
+		return fw.setupIPMasq(ipn, chain, comment)
+	}
+	return ip.SetupIPMasq(ipn, chain, comment)
+}
+
+// Undo setupIPMasq for the addresses of a pod, with ip6tables for IPv6
+// addresses
+func teardownIPMasq(ipns []*net.IPNet, chain, comment string) error {
+	fw, err := connectFirewalld()
+	if err != nil {
+		return err
+	}
+	if fw != nil {
+		return fw.teardownIPMasq(ipns, chain, comment)
+	}
+
+	for _, ipn := range ipns {
+		proto := iptables.ProtocolIPv4
+		if ipn.IP.To4() == nil {
+			proto = iptables.ProtocolIPv6
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+
+		network := ip.Network(ipn)
+		if err = ipt.Delete("nat", "POSTROUTING", "-s", network.String(), "-j", chain, "-m", "comment", "--comment", comment); err != nil {
+			return err
+		}
+	}
+
+	// The chain is shared by the addresses of a family
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		if !hasFamily(ipns, proto == iptables.ProtocolIPv6) {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		if err = ipt.ClearChain("nat", chain); err != nil {
+			return err
+		}
+		if err = ipt.DeleteChain("nat", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The networks setupIPMasq was called for, as recorded by the ACCEPT rules
+// of the chain of the pod. In routed mode the pod addresses are /32 and
+// /128, which aren't the IPAM networks the rules were added for. The
+// networks of the addresses are used when the chain can't be read.
+func masqNetworks(ipns []*net.IPNet, chain string) []*net.IPNet {
+	var rules [][]string
+	if fw, err := connectFirewalld(); err == nil && fw != nil {
+		rules = fw.chainRules(ipns, "nat", chain)
+	} else {
+		for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+			if !hasFamily(ipns, proto == iptables.ProtocolIPv6) {
+				continue
+			}
+			ipt, err := iptables.NewWithProtocol(proto)
+			if err != nil {
+				continue
+			}
+			lines, err := ipt.List("nat", chain)
+			if err != nil {
+				continue
+			}
+			for _, line := range lines {
+				rules = append(rules, strings.Fields(line))
+			}
+		}
+	}
+	return masqRuleNetworks(ipns, rules)
+}
+
+// The networks of the ACCEPT rules, falling back to the networks of the
+// addresses of the families without any
+func masqRuleNetworks(ipns []*net.IPNet, rules [][]string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, rule := range rules {
+		if !contains(rule, "ACCEPT") {
+			continue
+		}
+		for i := 0; i+1 < len(rule); i++ {
+			if rule[i] != "-d" {
+				continue
+			}
+			if _, network, err := net.ParseCIDR(rule[i+1]); err == nil {
+				networks = append(networks, network)
+			}
+		}
+	}
+	for _, ipn := range ipns {
+		// Families without rules
+		if !hasFamily(networks, ipn.IP.To4() == nil) {
+			networks = append(networks, ip.Network(ipn))
+		}
+	}
+	return networks
+}
+
+func hasFamily(ipns []*net.IPNet, v6 bool) bool {
+	for _, ipn := range ipns {
+		if (ipn.IP.To4() == nil) == v6 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMasqRuleNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		addrs []string
+		rules []string
+		want  []string
+	}{
+		{
+			"bridged",
+			[]string{"10.244.1.7/24"},
+			[]string{
+				"-N CNI-abc",
+				"-A CNI-abc -d 10.244.1.0/24 -m comment --comment \"name: ipsec\" -j ACCEPT",
+				"-A CNI-abc ! -d 224.0.0.0/4 -j MASQUERADE",
+			},
+			[]string{"10.244.1.0/24"},
+		},
+		{
+			"routed",
+			[]string{"10.244.1.7/32", "fd00::7/128"},
+			[]string{
+				"-A CNI-abc -d 10.244.1.0/24 -j ACCEPT",
+				"-A CNI-abc -d fd00::/64 -j ACCEPT",
+			},
+			[]string{"10.244.1.0/24", "fd00::/64"},
+		},
+		{
+			"no rules",
+			[]string{"10.244.1.7/32", "fd00::7/128"},
+			nil,
+			[]string{"10.244.1.7/32", "fd00::7/128"},
+		},
+		{
+			"v6 rules missing",
+			[]string{"10.244.1.7/32", "fd00::7/128"},
+			[]string{"-A CNI-abc -d 10.244.1.0/24 -j ACCEPT"},
+			[]string{"10.244.1.0/24", "fd00::7/128"},
+		},
+	} {
+		var ipns []*net.IPNet
+		for _, addr := range tc.addrs {
+			ip, ipn, err := net.ParseCIDR(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipn.IP = ip
+			ipns = append(ipns, ipn)
+		}
+		var rules [][]string
+		for _, rule := range tc.rules {
+			rules = append(rules, strings.Fields(rule))
+		}
+		var got []string
+		for _, network := range masqRuleNetworks(ipns, rules) {
+			got = append(got, network.String())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The plugin only lives for the duration of a CNI call, so metrics are kept
+// in the state directory between calls and rendered in the Prometheus text
+// format into metricsDir, for node_exporter's textfile collector to pick up.
+const (
+	metricsFile     = "metrics.json"
+	metricsPromFile = "strongswan_cni.prom"
+)
+
+type metrics struct {
+	// Keys are series, eg: strongswan_cni_tunnels or
+	// strongswan_cni_tunnel_limit_total{action="reject"}
+	Counters   map[string]float64    `json:"counters"`
+	Gauges     map[string]float64    `json:"gauges"`
+	Histograms map[string]*histogram `json:"histograms"`
+}
+
+type histogram struct {
+	// Upper bounds of the buckets, +Inf is implied
+	Buckets []float64 `json:"buckets"`
+	// Observations per bucket, not cumulative, the last one is +Inf
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+}
+
+func (m *metrics) inc(series string) {
+	m.Counters[series]++
+}
+
+func (m *metrics) set(series string, value float64) {
+	m.Gauges[series] = value
+}
+
+// Observe value in the histogram series, created with buckets the first time
+func (m *metrics) observe(series string, buckets []float64, value float64) {
+	h := m.Histograms[series]
+	if h == nil {
+		h = &histogram{Buckets: buckets, Counts: make([]uint64, len(buckets)+1)}
+		m.Histograms[series] = h
+	}
+	i := sort.SearchFloat64s(h.Buckets, value)
+	h.Counts[i]++
+	h.Sum += value
+}
+
+// Load the metrics, let update change them and save them back. The caller
+// must hold the state lock.
+func updateMetrics(metricsDir string, update func(m *metrics)) error {
+	m, err := loadMetrics()
+	if err != nil {
+		return err
+	}
+
+	update(m)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir, metricsFile)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+
+	if metricsDir == "" {
+		return nil
+	}
+	// Write then rename so the collector never reads a partial file
+	prom := filepath.Join(metricsDir, metricsPromFile)
+	if err := ioutil.WriteFile(prom+".tmp", m.render(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(prom+".tmp", prom)
+}
+
+// The caller must hold the state lock
+func loadMetrics() (*metrics, error) {
+	m := &metrics{
+		Counters:   map[string]float64{},
+		Gauges:     map[string]float64{},
+		Histograms: map[string]*histogram{},
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, metricsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("failed to load metrics: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// Render the metrics in the Prometheus text format
+func (m *metrics) render() []byte {
+	var b bytes.Buffer
+	renderSeries(&b, "counter", m.Counters)
+	renderSeries(&b, "gauge", m.Gauges)
+	renderHistograms(&b, m.Histograms)
+	return b.Bytes()
+}
+
+func renderSeries(b *bytes.Buffer, kind string, values map[string]float64) {
+	series := make([]string, 0, len(values))
+	for s := range values {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+
+	family := ""
+	for _, s := range series {
+		name := s
+		if i := strings.Index(s, "{"); i >= 0 {
+			name = s[:i]
+		}
+		if name != family {
+			family = name
+			fmt.Fprintf(b, "# TYPE %s %s\n", name, kind)
+		}
+		fmt.Fprintf(b, "%s %v\n", s, values[s])
+	}
+}
+
+func renderHistograms(b *bytes.Buffer, histograms map[string]*histogram) {
+	series := make([]string, 0, len(histograms))
+	for s := range histograms {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+
+	family := ""
+	for _, s := range series {
+		name, labels := s, ""
+		if i := strings.Index(s, "{"); i >= 0 {
+			name, labels = s[:i], strings.TrimSuffix(s[i+1:], "}")+","
+		}
+		if name != family {
+			family = name
+			fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+		}
+
+		h := histograms[s]
+		var count uint64
+		for i, c := range h.Counts {
+			count += c
+			le := "+Inf"
+			if i < len(h.Buckets) {
+				le = fmt.Sprint(h.Buckets[i])
+			}
+			fmt.Fprintf(b, "%s_bucket{%sle=%q} %d\n", name, labels, le, count)
+		}
+		suffix := ""
+		if labels != "" {
+			suffix = "{" + strings.TrimSuffix(labels, ",") + "}"
+		}
+		fmt.Fprintf(b, "%s_sum%s %v\n", name, suffix, h.Sum)
+		fmt.Fprintf(b, "%s_count%s %d\n", name, suffix, count)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// Announce the addresses of the container interface with gratuitous ARP and
+// unsolicited neighbor advertisements, so the bridge, the host and the
+// gateway update their caches right away, even when the MAC address was
+// just rewritten. Must run in the container namespace. Announcements are
+// best effort, failures are only logged.
+func announceAddrs(ifName string, result *current.Result) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		log.Println(logPrefix, "failed to announce addresses:", err)
+		return
+	}
+
+	for _, ipc := range result.IPs {
+		addr := ipc.Address.IP
+		if addr.To4() != nil {
+			err = sendGratuitousARP(iface, addr.To4())
+		} else {
+			err = sendUnsolicitedNA(iface, addr)
+		}
+		if err != nil {
+			log.Println(logPrefix, "failed to announce", addr, "on", ifName+":", err)
+		}
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// Broadcast an ARP request for our own address
+func sendGratuitousARP(iface *net.Interface, addr net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = append(frame, 0x08, 0x06) // ARP
+	frame = append(frame,
+		0x00, 0x01, // Ethernet
+		0x08, 0x00, // IPv4
+		6, 4,
+		0x00, 0x01, // request
+	)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = append(frame, addr...)
+	frame = append(frame, make([]byte, 6)...)
+	frame = append(frame, addr...)
+
+	to := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(to.Addr[:], broadcast)
+	return syscall.Sendto(fd, frame, 0, to)
+}
+
+// Advertise our own address to all nodes, with the override flag so
+// existing cache entries are replaced
+func sendUnsolicitedNA(iface *net.Interface, addr net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("failed to open ICMPv6 socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	// Neighbor discovery messages are dropped unless the hop limit is 255
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index); err != nil {
+		return err
+	}
+
+	// The kernel computes the checksum of ICMPv6 raw sockets
+	msg := make([]byte, 8, 32)
+	msg[0] = 136 // neighbor advertisement
+	binary.BigEndian.PutUint32(msg[4:], 0x20000000)
+	msg = append(msg, addr.To16()...)
+	msg = append(msg, 2, 1) // target link-layer address option
+	msg = append(msg, iface.HardwareAddr...)
+
+	to := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(to.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, msg, 0, to)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With gatewayPin, the gateway must authenticate with one certificate or
+// public key rather than with any certificate the trusted CAs issued for
+// it, so a compromised CA can't be used to impersonate it. The pin is
+// either the SHA-256 fingerprint of the certificate in hex, colons optional,
+// as openssl x509 -fingerprint prints it, or sha256// followed by the base64
+// SHA-256 of its SubjectPublicKeyInfo, as curl --pinnedpubkey takes it, which
+// still matches once the gateway renewed its certificate with the same key.
+// The certificate or key itself is looked up in the PEM files of
+// gatewayCerts, and given to charon as rightcert or rightsigkey.
+const (
+	defaultGatewayCerts = "/etc/cni/strongswan/gateways"
+	keyPinPrefix        = "sha256//"
+
+	gatewayCertFile = "gateway.crt"
+	gatewayKeyFile  = "gateway.pub"
+)
+
+func validateGatewayPin(vpnInfo vpnInfo) error {
+	if vpnInfo.GatewayPin == "" {
+		return nil
+	}
+	if vpnInfo.Auth != authCert {
+		return fmt.Errorf("gatewayPin requires auth %q", authCert)
+	}
+	_, err := parseGatewayPin(vpnInfo.GatewayPin)
+	return err
+}
+
+// The SHA-256 digest of a pin
+func parseGatewayPin(pin string) ([]byte, error) {
+	var digest []byte
+	var err error
+	if strings.HasPrefix(pin, keyPinPrefix) {
+		digest, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, keyPinPrefix))
+	} else {
+		digest, err = hex.DecodeString(strings.Replace(pin, ":", "", -1))
+	}
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid gatewayPin %q: expected a SHA-256 certificate fingerprint or %s<base64 SHA-256 of the public key>", pin, keyPinPrefix)
+	}
+	return digest, nil
+}
+
+// Find the pinned certificate or key in gatewayCerts and put it into the
+// ipsec.d of the namespace
+func installGatewayPin(netNs string, vpnInfo vpnInfo) error {
+	if vpnInfo.GatewayPin == "" {
+		return nil
+	}
+	dir := vpnInfo.GatewayCerts
+	if dir == "" {
+		dir = defaultGatewayCerts
+	}
+	digest, err := parseGatewayPin(vpnInfo.GatewayPin)
+	if err != nil {
+		return err
+	}
+	pinsKey := strings.HasPrefix(vpnInfo.GatewayPin, keyPinPrefix)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read gatewayCerts: %v", err)
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			var pinned *pem.Block
+			switch {
+			case block.Type == "CERTIFICATE" && !pinsKey:
+				if sum := sha256.Sum256(block.Bytes); bytes.Equal(sum[:], digest) {
+					pinned = block
+				}
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					continue
+				}
+				if sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo); bytes.Equal(sum[:], digest) {
+					pinned = &pem.Block{Type: "PUBLIC KEY", Bytes: cert.RawSubjectPublicKeyInfo}
+				}
+			case block.Type == "PUBLIC KEY" && pinsKey:
+				if sum := sha256.Sum256(block.Bytes); bytes.Equal(sum[:], digest) {
+					pinned = block
+				}
+			}
+			if pinned != nil {
+				return writeGatewayPin(netNs, pinned)
+			}
+		}
+	}
+	return fmt.Errorf("no certificate or public key in %q matches gatewayPin %q", dir, vpnInfo.GatewayPin)
+}
+
+func writeGatewayPin(netNs string, block *pem.Block) error {
+	name := gatewayCertFile
+	if block.Type == "PUBLIC KEY" {
+		name = gatewayKeyFile
+	}
+	path := filepath.Join(netnsConfDir(netNs), "ipsec.d", "certs", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0644)
+}
+
+// The option making charon only accept the pinned certificate or key
+func gatewayPinOption(vpnInfo vpnInfo) string {
+	if strings.HasPrefix(vpnInfo.GatewayPin, keyPinPrefix) {
+		return "rightsigkey=" + gatewayKeyFile
+	}
+	return "rightcert=" + gatewayCertFile
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	authPSK  = "psk"
+	authCert = "cert"
+
+	defaultNodeCACert   = "/etc/cni/strongswan/node-ca.crt"
+	defaultNodeCAKey    = "/etc/cni/strongswan/node-ca.key"
+	defaultCABundle     = "/etc/cni/strongswan/ca.crt"
+	defaultCertLifetime = "7d"
+
+	certRenewInterval = time.Hour
+	nodeCARetries     = 5
+)
+
+func validateAuth(vpnInfo vpnInfo) error {
+	switch vpnInfo.Auth {
+	case "", authPSK, authCert:
+	default:
+		return fmt.Errorf("invalid auth %q: must be %q or %q", vpnInfo.Auth, authPSK, authCert)
+	}
+	return validateIpsecTime("certLifetime", vpnInfo.CertLifetime)
+}
+
+// Mint a keypair and a certificate for the pod, signed by the node
+// intermediate CA, and put them with the trusted CAs into the ipsec.d of the
+// namespace. Everything goes away with the namespace directory, a new pod
+// gets a new certificate, and the daemon renews those of long-lived pods.
+func issuePodCert(netNs string, vpnInfo vpnInfo) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	return writePodCert(netNs, vpnInfo, key)
+}
+
+func writePodCert(netNs string, vpnInfo vpnInfo, key *ecdsa.PrivateKey) error {
+	caCertPath, caKeyPath, bundlePath := vpnInfo.NodeCACert, vpnInfo.NodeCAKey, vpnInfo.CABundle
+	if caCertPath == "" {
+		caCertPath = defaultNodeCACert
+	}
+	if caKeyPath == "" {
+		caKeyPath = defaultNodeCAKey
+	}
+	if bundlePath == "" {
+		bundlePath = defaultCABundle
+	}
+	lifetime := vpnInfo.CertLifetime
+	if lifetime == "" {
+		lifetime = defaultCertLifetime
+	}
+
+	caCert, caKey, err := loadNodeCA(caCertPath, caKeyPath)
+	if err != nil {
+		return err
+	}
+	bundle, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		return fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+
+	// The pod authenticates as @netNs, strongSwan matches it against the
+	// dNSName of the certificate
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: netNs},
+		DNSNames:    []string{netNs},
+		NotBefore:   time.Now().Add(-5 * time.Minute),
+		NotAfter:    time.Now().Add(ipsecDuration(lifetime)),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certPEM, err := signCert(template, caCert, key.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	ipsecDir := netnsConfDir(netNs) + "/ipsec.d"
+	files := []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{filepath.Join(ipsecDir, "private", "pod.key"), keyPEM, 0600},
+		{filepath.Join(ipsecDir, "certs", "pod.crt"), certPEM, 0644},
+		{filepath.Join(ipsecDir, "cacerts", "node-ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644},
+		{filepath.Join(ipsecDir, "cacerts", "ca.crt"), bundle, 0644},
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(f.path, f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load the node intermediate and its key. The controller and ca sync
+// replace them one file after the other, so they are read again, a few
+// times, until the key is the one of the certificate.
+func loadNodeCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	for i := 0; ; i++ {
+		cert, err := loadCert(certPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := loadKey(keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if ok && pub.Equal(cert.PublicKey) {
+			return cert, key, nil
+		}
+		if i == nodeCARetries {
+			return nil, nil, fmt.Errorf("%q isn't the key of %q", keyPath, certPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Renew the certificates of the running pods once two thirds of their
+// lifetime went by, for the same key, which charon keeps in memory, and along
+// with the current node intermediate. charon then rereads the CAs and reloads
+// the connections, the IKE_SAs established from then on use the new
+// certificate.
+func renewPodCerts() {
+	unlock, err := lockState()
+	if err != nil {
+		log.Println(logPrefix, "failed to renew certificates:", err)
+		return
+	}
+	states, err := loadTunnelStates()
+	unlock()
+	if err != nil {
+		log.Println(logPrefix, "failed to renew certificates:", err)
+		return
+	}
+
+	for _, s := range states {
+		if s.VPN.Auth != authCert || !charonRunning(s.ID) {
+			continue
+		}
+		ipsecDir := netnsConfDir(s.ID) + "/ipsec.d"
+		cert, err := loadCert(filepath.Join(ipsecDir, "certs", "pod.crt"))
+		if err != nil {
+			log.Println(logPrefix, "failed to renew the certificate of", s.ContainerID+":", err)
+			continue
+		}
+		if time.Until(cert.NotAfter) > cert.NotAfter.Sub(cert.NotBefore)/3 {
+			continue
+		}
+		signer, err := loadKey(filepath.Join(ipsecDir, "private", "pod.key"))
+		key, ok := signer.(*ecdsa.PrivateKey)
+		if err != nil || !ok {
+			log.Println(logPrefix, "failed to renew the certificate of", s.ContainerID+": no ECDSA key:", err)
+			continue
+		}
+		if err := writePodCert(s.ID, s.VPN, key); err != nil {
+			log.Println(logPrefix, "failed to renew the certificate of", s.ContainerID+":", err)
+			continue
+		}
+		for _, args := range [][]string{{"ipsec", "rereadall"}, {"ipsec", "reload"}} {
+			if out, err := netnsCommand(s.ID, args...).CombinedOutput(); err != nil {
+				log.Println(logPrefix, "failed to", args[1], "the credentials of", s.ContainerID+":", err, string(out))
+			}
+		}
+		log.Println(logPrefix, "renewed the certificate of", s.ContainerID)
+	}
+}
+
+// Sign template with the given CA, or self-sign it when parent is nil
+func signCert(template *x509.Certificate, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %q: %v", template.Subject.CommonName, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func loadCert(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%q is not a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func loadKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%q is not a PEM private key", path)
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *ecdsa.PrivateKey:
+			return k, nil
+		case *rsa.PrivateKey:
+			return k, nil
+		}
+	}
+	return nil, errors.New("unsupported private key type in " + path)
+}
+
+// Convert a validated ipsec.conf time to a duration
+func ipsecDuration(value string) time.Duration {
+	unit := time.Second
+	switch value[len(value)-1] {
+	case 's':
+		value = value[:len(value)-1]
+	case 'm':
+		unit, value = time.Minute, value[:len(value)-1]
+	case 'h':
+		unit, value = time.Hour, value[:len(value)-1]
+	case 'd':
+		unit, value = 24*time.Hour, value[:len(value)-1]
+	}
+	n, _ := strconv.Atoi(value)
+	return time.Duration(n) * unit
+}
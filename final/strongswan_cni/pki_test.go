@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIpsecDuration(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"45s", 45 * time.Second},
+		{"10m", 10 * time.Minute},
+		{"3h", 3 * time.Hour},
+		{"90d", 90 * 24 * time.Hour},
+		{"0s", 0},
+	} {
+		if got := ipsecDuration(tc.value); got != tc.want {
+			t.Errorf("ipsecDuration(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
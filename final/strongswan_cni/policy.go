@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Minimum cryptographic strength of the tunnels. Configured proposals are
+// checked when the config is loaded and made strict, and the algorithms
+// actually negotiated are checked again when the CHILD_SA comes up.
+type cryptoPolicy struct {
+	// Minimum encryption key size in bits
+	MinKeySize int `json:"minKeySize"`
+	// Weakest DH group allowed, eg: modp2048 or ecp256
+	MinDHGroup string `json:"minDHGroup"`
+	// Algorithms refused on top of the ones which are always refused
+	Forbid []string `json:"forbid"`
+}
+
+// Never acceptable, whatever the policy says
+var weakAlgorithms = []string{"null", "des", "3des", "md5", "blowfish", "cast128", "modp768", "modp1024", "modp1536"}
+
+// Approximate strength in bits of security of the DH groups
+var dhStrength = map[string]int{
+	"modp768": 60, "modp1024": 80, "modp1536": 90, "modp2048": 112,
+	"modp3072": 128, "modp4096": 152, "modp6144": 176, "modp8192": 192,
+	"modp1024s160": 80, "modp2048s224": 112, "modp2048s256": 112,
+	"ecp192": 96, "ecp224": 112, "ecp256": 128, "ecp384": 192, "ecp521": 256,
+	"ecp224bp": 112, "ecp256bp": 128, "ecp384bp": 192, "ecp512bp": 256,
+	"curve25519": 128, "x25519": 128, "curve448": 224, "x448": 224,
+}
+
+// A copy sharing nothing with p, json.Unmarshal writes patches into the
+// policy a pointer leads to
+func (p *cryptoPolicy) clone() *cryptoPolicy {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	if p.Forbid != nil {
+		c.Forbid = append(make([]string, 0, len(p.Forbid)), p.Forbid...)
+	}
+	return &c
+}
+
+var cipherKeySizeRegexp = regexp.MustCompile(`^(aes|camellia|serpent|twofish)(\d*)`)
+
+func validateCryptoPolicy(vpnInfo vpnInfo) error {
+	p := vpnInfo.MinStrength
+	if p == nil {
+		return nil
+	}
+	if p.MinDHGroup != "" {
+		if _, ok := dhStrength[p.MinDHGroup]; !ok {
+			return fmt.Errorf("unknown minDHGroup %q", p.MinDHGroup)
+		}
+	}
+	// Without explicit proposals charon would offer its defaults, which
+	// can't be checked here
+	if vpnInfo.IKEProposal == "" || vpnInfo.ESPProposal == "" {
+		return fmt.Errorf("ike and esp proposals are required with minStrength")
+	}
+
+	for _, proposals := range []string{vpnInfo.IKEProposal, vpnInfo.ESPProposal} {
+		for _, proposal := range strings.Split(strings.TrimSuffix(proposals, "!"), ",") {
+			for _, alg := range strings.Split(proposal, "-") {
+				if err := p.check(alg); err != nil {
+					return fmt.Errorf("proposal %q is too weak: %v", proposal, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Check a single algorithm of a proposal, in ipsec.conf syntax
+func (p *cryptoPolicy) check(alg string) error {
+	alg = strings.ToLower(alg)
+	for _, weak := range append(weakAlgorithms, p.Forbid...) {
+		if alg == strings.ToLower(weak) {
+			return fmt.Errorf("%s is not allowed", alg)
+		}
+	}
+
+	if m := cipherKeySizeRegexp.FindStringSubmatch(alg); m != nil {
+		size := 128
+		if m[2] != "" {
+			size, _ = strconv.Atoi(m[2])
+		}
+		if size < p.MinKeySize {
+			return fmt.Errorf("%s has a key smaller than %d bits", alg, p.MinKeySize)
+		}
+	}
+
+	if strength, ok := dhStrength[alg]; ok && p.MinDHGroup != "" && strength < dhStrength[p.MinDHGroup] {
+		return fmt.Errorf("%s is weaker than %s", alg, p.MinDHGroup)
+	}
+	return nil
+}
+
+// Kernel names of the algorithms, as seen in xfrm states, and their
+// ipsec.conf names
+var xfrmAlgorithms = map[string]string{
+	"cipher_null": "null", "digest_null": "null", "ecb(cipher_null)": "null",
+	"des": "des", "des3_ede": "3des", "md5": "md5", "sha1": "sha1",
+	"blowfish": "blowfish", "cast5": "cast128",
+	"aes": "aes", "camellia": "camellia", "serpent": "serpent", "twofish": "twofish",
+}
+
+var xfrmAlgRegexp = regexp.MustCompile(`([a-z0-9_]+)\)*$`)
+
+// Check the algorithms the kernel actually uses for state
+func (p *cryptoPolicy) checkState(state netlink.XfrmState) error {
+	type alg struct {
+		name    string
+		keyBits int
+	}
+	var algs []alg
+	if state.Crypt != nil {
+		algs = append(algs, alg{state.Crypt.Name, len(state.Crypt.Key) * 8})
+	}
+	if state.Auth != nil {
+		algs = append(algs, alg{state.Auth.Name, 0})
+	}
+	if state.Aead != nil {
+		// The AEAD key ends with a 32 bits salt, eg: rfc4106(gcm(aes))
+		algs = append(algs, alg{strings.Split(state.Aead.Name, ",")[0], (len(state.Aead.Key) - 4) * 8})
+	}
+
+	for _, a := range algs {
+		name := a.name
+		if m := xfrmAlgRegexp.FindStringSubmatch(strings.TrimPrefix(a.name, "hmac(")); m != nil {
+			name = m[1]
+		}
+		if known, ok := xfrmAlgorithms[name]; ok {
+			name = known
+		}
+		if a.keyBits > 0 && cipherKeySizeRegexp.MatchString(name) {
+			name += strconv.Itoa(a.keyBits)
+		}
+		if err := p.check(name); err != nil {
+			return fmt.Errorf("SA %#x uses %s: %v", state.Spi, a.name, err)
+		}
+	}
+	return nil
+}
+
+// Make proposals strict, so charon never falls back to its defaults
+func strictProposal(proposals string) string {
+	if strings.HasSuffix(proposals, "!") {
+		return proposals
+	}
+	return proposals + "!"
+}
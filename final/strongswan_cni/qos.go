@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	dscpChain = "STRONGSWAN-DSCP"
+
+	// The inner DSCP is carried over to the ESP packet in these bits of the
+	// packet mark, the mark survives the xfrm transformation
+	dscpMarkShift = 24
+	dscpMarkMask  = 0x3f << dscpMarkShift
+
+	ikePrioChain = "STRONGSWAN-IKE-PRIO"
+)
+
+// Well known DSCP class names, as accepted by iptables --set-dscp-class
+var dscpClasses = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46,
+}
+
+// parseDSCP validates the dscp option of vpn. It returns copy=true when the
+// inner DSCP has to be copied to the outer header, otherwise the fixed DSCP
+// value to set, or -1 when nothing has to be done
+func parseDSCP(dscp string) (bool, int, error) {
+	switch dscp {
+	case "":
+		return false, -1, nil
+	case "copy":
+		return true, -1, nil
+	}
+
+	if v, ok := dscpClasses[strings.ToUpper(dscp)]; ok {
+		return false, v, nil
+	}
+
+	v, err := strconv.Atoi(dscp)
+	if err != nil || v < 0 || v > 63 {
+		return false, -1, fmt.Errorf("invalid dscp %q: must be \"copy\", a class name or a value between 0 and 63", dscp)
+	}
+	return false, v, nil
+}
+
+// Mark the ESP packets leaving the pod with a DSCP so QoS-aware underlay
+// networks can prioritize tunnel traffic. charon runs inside the pod network
+// namespace, hence the outer header is built there and so are the rules
+func setupDSCP(netns ns.NetNS, vpnInfo vpnInfo) error {
+	copyDSCP, value, err := parseDSCP(vpnInfo.DSCP)
+	if err != nil {
+		return err
+	}
+	if !copyDSCP && value < 0 {
+		return nil
+	}
+
+	rules := dscpRules(copyDSCP, value)
+	restore := "iptables-restore"
+	if ip := net.ParseIP(vpnInfo.ServerIP); ip != nil && ip.To4() == nil {
+		restore = "ip6tables-restore"
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		cmd := exec.Command(restore, "--noflush")
+		cmd.Stdin = strings.NewReader(rules)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to install dscp rules: %v: %s", err, out.String())
+		}
+		return nil
+	})
+}
+
+// Generate the mangle table for iptables-restore. When copying, the inner
+// DSCP is saved into the packet mark on OUTPUT and restored on the ESP packet
+// in POSTROUTING. A fixed class is simply set on every ESP packet.
+func dscpRules(copyDSCP bool, value int) string {
+	var b bytes.Buffer
+	b.WriteString("*mangle\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", dscpChain)
+
+	esp := []string{"-p esp", "-p udp --dport 4500"}
+	if copyDSCP {
+		// Don't let the ESP packet itself overwrite the saved value
+		for _, match := range esp {
+			fmt.Fprintf(&b, "-A %s %s -j RETURN\n", dscpChain, match)
+		}
+		for v := 0; v < 64; v++ {
+			fmt.Fprintf(&b, "-A %s -m dscp --dscp %d -j MARK --set-xmark %#x/%#x\n", dscpChain, v, v<<dscpMarkShift, dscpMarkMask)
+		}
+		fmt.Fprintf(&b, "-A OUTPUT -j %s\n", dscpChain)
+		for _, match := range esp {
+			for v := 1; v < 64; v++ {
+				fmt.Fprintf(&b, "-A POSTROUTING %s -m mark --mark %#x/%#x -j DSCP --set-dscp %d\n", match, v<<dscpMarkShift, dscpMarkMask, v)
+			}
+		}
+	} else {
+		for _, match := range esp {
+			fmt.Fprintf(&b, "-A %s %s -j DSCP --set-dscp %d\n", dscpChain, match, value)
+		}
+		fmt.Fprintf(&b, "-A POSTROUTING -j %s\n", dscpChain)
+	}
+
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// Give IKE packets priority over bulk pod traffic on the host uplink so a
+// saturated link doesn't make rekeys time out. IKE gets the priority of
+// interactive traffic, which the default priomap of prio qdiscs puts in
+// their first band whatever their handle, and prio qdiscs are put on the
+// interface towards the VPN server, one per TX queue on multiqueue NICs.
+// Everything else follows the default priomap.
+func prioritizeIKE(h *netlink.Handle, serverIP string) error {
+	server := net.ParseIP(serverIP)
+	if server == nil {
+		return fmt.Errorf("invalid vpn serverIP %q", serverIP)
+	}
+
+	routes, err := h.RouteGet(server)
+	if err != nil || len(routes) == 0 {
+		return fmt.Errorf("failed to find route to %v: %v", server, err)
+	}
+	uplink, err := h.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return fmt.Errorf("failed to lookup uplink to %v: %v", server, err)
+	}
+
+	if err := ensurePrioQdisc(h, uplink); err != nil {
+		return err
+	}
+
+	proto := iptables.ProtocolIPv4
+	if server.To4() == nil {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return err
+	}
+	if err := ensureChain(ipt, "mangle", ikePrioChain); err != nil {
+		return err
+	}
+	for _, rule := range ikePrioRules(proto) {
+		if err := ipt.AppendUnique("mangle", ikePrioChain, rule...); err != nil {
+			return err
+		}
+	}
+	return ipt.AppendUnique("mangle", "POSTROUTING", "-o", uplink.Attrs().Name, "-j", ikePrioChain)
+}
+
+// TC_PRIO_INTERACTIVE, no major so it never matches a class by handle
+var ikePrioClass = []string{"-j", "CLASSIFY", "--set-class", "0:6"}
+
+func ikePrioRules(proto iptables.Protocol) [][]string {
+	// On 4500 only the packets with a non-ESP marker are IKE, the rest is
+	// NAT-T encapsulated ESP
+	nonESP := "0>>22&0x3C@8=0"
+	if proto == iptables.ProtocolIPv6 {
+		// The IPv6 header has a fixed size, no need to compute the offset
+		nonESP = "48=0"
+	}
+	return [][]string{
+		append([]string{"-p", "udp", "--dport", "500"}, ikePrioClass...),
+		append([]string{"-p", "udp", "--dport", "4500", "-m", "u32", "--u32", nonESP}, ikePrioClass...),
+	}
+}
+
+// Handles of the prio qdiscs: the root one, or the ones under each TX queue
+// of an mq root, from ikePrioQueueBase+1 on
+const (
+	ikePrioRootHandle = 1
+	ikePrioQueueBase  = 0x5300
+)
+
+// Put prio qdiscs on link unless they're already there. Only the qdiscs the
+// kernel attached by default, with handle 0:, are replaced: under an mq root
+// each TX queue gets its own prio, so the queues are kept, else the root one
+// is replaced. A root qdisc set up by the admin, eg: for shaping, is left
+// alone, IKE is only classified then.
+func ensurePrioQdisc(h *netlink.Handle, link netlink.Link) error {
+	qdiscs, err := h.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+	var root netlink.Qdisc
+	prios := map[uint32]bool{}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_ROOT {
+			root = q
+		}
+		if q.Type() == "prio" {
+			prios[q.Attrs().Handle] = true
+		}
+	}
+
+	parents := []uint32{netlink.HANDLE_ROOT}
+	handles := []uint32{netlink.MakeHandle(ikePrioRootHandle, 0)}
+	switch {
+	case root == nil:
+	case root.Type() == "prio" && root.Attrs().Handle == handles[0]:
+		return nil
+	case root.Type() == "mq" && root.Attrs().Handle == 0:
+		parents, handles = nil, nil
+		for i := 1; i <= link.Attrs().NumTxQueues; i++ {
+			parents = append(parents, netlink.MakeHandle(0, uint16(i)))
+			handles = append(handles, netlink.MakeHandle(uint16(ikePrioQueueBase+i), 0))
+		}
+	case root.Attrs().Handle != 0:
+		log.Println(logPrefix, "leaving the", root.Type(), "root qdisc of", link.Attrs().Name, "alone, IKE is only classified")
+		return nil
+	}
+
+	for i, parent := range parents {
+		if prios[handles[i]] {
+			continue
+		}
+		prio := netlink.NewPrio(netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    handles[i],
+			Parent:    parent,
+		})
+		if err := h.QdiscReplace(prio); err != nil {
+			return fmt.Errorf("failed to set prio qdisc on %q: %v", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Undo prioritizeIKE once no pod uses it anymore: the uplinks are those the
+// POSTROUTING rules jump to the chain for. Deleting the prio qdiscs makes
+// the kernel attach its default ones again.
+func removeIKEPriority() error {
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			continue
+		}
+		exists, err := chainExists(ipt, "mangle", ikePrioChain)
+		if err != nil || !exists {
+			continue
+		}
+		rules, err := ipt.List("mangle", "POSTROUTING")
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			f := strings.Fields(rule)
+			if len(f) != 6 || f[2] != "-o" || f[4] != "-j" || f[5] != ikePrioChain {
+				continue
+			}
+			if err := ipt.Delete("mangle", "POSTROUTING", f[2:]...); err != nil {
+				return err
+			}
+			if err := removePrioQdisc(f[3]); err != nil {
+				return err
+			}
+		}
+		if err := ipt.ClearChain("mangle", ikePrioChain); err != nil {
+			return err
+		}
+		if err := ipt.DeleteChain("mangle", ikePrioChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removePrioQdisc(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		// Gone along with its qdiscs
+		return nil
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", name, err)
+	}
+	for _, q := range qdiscs {
+		major, _ := netlink.MajorMinor(q.Attrs().Handle)
+		ours := q.Attrs().Parent == netlink.HANDLE_ROOT && major == ikePrioRootHandle ||
+			q.Attrs().Parent != netlink.HANDLE_ROOT && major > ikePrioQueueBase && major <= ikePrioQueueBase+uint16(link.Attrs().NumTxQueues)
+		if q.Type() != "prio" || !ours {
+			continue
+		}
+		if err := netlink.QdiscDel(q); err != nil {
+			return fmt.Errorf("failed to delete prio qdisc of %q: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseDSCP(t *testing.T) {
+	for _, tc := range []struct {
+		dscp  string
+		copy  bool
+		value int
+		ok    bool
+	}{
+		{"", false, -1, true},
+		{"copy", true, -1, true},
+		{"EF", false, 46, true},
+		{"af41", false, 34, true},
+		{"cs6", false, 48, true},
+		{"0", false, 0, true},
+		{"63", false, 63, true},
+		{"64", false, -1, false},
+		{"-1", false, -1, false},
+		{"af44", false, -1, false},
+		{"Copy", false, -1, false},
+	} {
+		copyDSCP, value, err := parseDSCP(tc.dscp)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseDSCP(%q): got error %v", tc.dscp, err)
+			continue
+		}
+		if copyDSCP != tc.copy || value != tc.value {
+			t.Errorf("parseDSCP(%q) = %v, %d, want %v, %d", tc.dscp, copyDSCP, value, tc.copy, tc.value)
+		}
+	}
+}
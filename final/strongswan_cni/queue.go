@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// With establishQueue, ADD doesn't start charon itself: once the pod
+// network and the charon configuration are ready, it queues the tunnel and
+// returns right away. The daemon starts the queued tunnels in order, at most
+// -queue-parallel at a time and -queue-rate per second, so a burst of pods
+// neither overruns the kubelet CNI timeout nor starts every charon and IKE
+// handshake at once. The daemon shows it runs by touching a heartbeat file;
+// without a recent one, ADD starts charon itself as usual.
+var (
+	queueDir      = filepath.Join(stateDir, "queue")
+	heartbeatPath = filepath.Join(stateDir, "daemon.heartbeat")
+)
+
+const (
+	queuePollInterval = 500 * time.Millisecond
+	// The daemon is considered gone when it missed several heartbeats
+	heartbeatTimeout = 10 * queuePollInterval
+)
+
+// Whether the daemon runs and starts the queued tunnels
+func queueServed() bool {
+	info, err := os.Stat(heartbeatPath)
+	return err == nil && time.Since(info.ModTime()) < heartbeatTimeout
+}
+
+func enqueueTunnel(id string) error {
+	if err := os.MkdirAll(queueDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(queueDir, id), nil, 0600); err != nil {
+		return fmt.Errorf("failed to queue the tunnel: %v", err)
+	}
+	return nil
+}
+
+func dequeueTunnel(id string) {
+	os.Remove(filepath.Join(queueDir, id))
+}
+
+func tunnelQueued(id string) bool {
+	_, err := os.Stat(filepath.Join(queueDir, id))
+	return err == nil
+}
+
+// The queued tunnel ids, oldest first
+func queuedTunnels() []string {
+	files, err := ioutil.ReadDir(queueDir)
+	if err != nil {
+		return nil
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, f.Name())
+	}
+	return ids
+}
+
+// Start the queued tunnels, forever
+func serveQueue(parallel int, rate float64) {
+	slots := make(chan struct{}, parallel)
+	inFlight := map[string]bool{}
+	done := make(chan string)
+	os.MkdirAll(stateDir, 0700)
+	// Token bucket, allowing bursts of up to a second worth of tunnels
+	tokens, burst := 1.0, math.Max(rate, 1)
+	last := time.Now()
+
+	for {
+		now := time.Now()
+		if err := os.Chtimes(heartbeatPath, now, now); os.IsNotExist(err) {
+			ioutil.WriteFile(heartbeatPath, nil, 0600)
+		}
+		tokens = math.Min(tokens+now.Sub(last).Seconds()*rate, burst)
+		last = now
+
+	drain:
+		for {
+			select {
+			case id := <-done:
+				delete(inFlight, id)
+			default:
+				break drain
+			}
+		}
+
+		for _, id := range queuedTunnels() {
+			if inFlight[id] {
+				continue
+			}
+			if len(slots) == cap(slots) || tokens < 1 {
+				break
+			}
+			slots <- struct{}{}
+			inFlight[id] = true
+			tokens--
+			go func(id string) {
+				startQueuedTunnel(id)
+				<-slots
+				done <- id
+			}(id)
+		}
+		time.Sleep(queuePollInterval)
+	}
+}
+
+func startQueuedTunnel(id string) {
+	defer dequeueTunnel(id)
+	s, err := loadTunnelState(id)
+	if err != nil {
+		// Deleted while queued
+		return
+	}
+	log.Println(logPrefix, "starting the queued tunnel of", s.ContainerID)
+	if err := startIpsec(s); err != nil {
+		log.Println(logPrefix, "failed to start the queued tunnel of", s.ContainerID+":", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// When the runtime calls ADD again for a sandbox which is already set up,
+// eg: after only the containers of the pod restarted, the namespace still
+// has its interface and the tunnel state is there. The existing setup is
+// then verified and returned, charon is only started when it isn't running
+// and the tunnel wasn't drained, rather than running IPAM again and starting
+// a second charon over the same config. ok is false when there's nothing to
+// reattach to.
+func reattachTunnel(h *netlink.Handle, args *skel.CmdArgs, n *NetConf) (result *current.Result, ok bool, err error) {
+	s, err := loadTunnelState(extractProcId(args.Netns))
+	if err != nil || s.Network != n.Name || s.NetNS != args.Netns || s.ContainerID != args.ContainerID || !podNetNSAlive(s) {
+		return nil, false, nil
+	}
+	log.Println(logPrefix, "reattaching to the tunnel of", s.ContainerID)
+
+	result = &current.Result{CNIVersion: current.ImplementedSpecVersion, DNS: n.DNS}
+	if n.Datapath != datapathRouted {
+		br, err := bridgeByName(h, n.BrName)
+		if err != nil {
+			return nil, false, err
+		}
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: br.Attrs().Name,
+			Mac:  br.Attrs().HardwareAddr.String(),
+		})
+	}
+	hostVeth, err := h.LinkByName(s.HostVeth)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lookup %q: %v", s.HostVeth, err)
+	}
+	result.Interfaces = append(result.Interfaces, &current.Interface{
+		Name: hostVeth.Attrs().Name,
+		Mac:  hostVeth.Attrs().HardwareAddr.String(),
+	})
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+	contIndex := len(result.Interfaces)
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name:    args.IfName,
+			Mac:     link.Attrs().HardwareAddr.String(),
+			Sandbox: args.Netns,
+		})
+		return podIPConfigs(link, s.IPs, contIndex, result)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !s.Drained && !charonRunning(s.ID) && !tunnelQueued(s.ID) {
+		if err := establishIpsec(s); err != nil {
+			return nil, false, err
+		}
+	}
+	return result, true, nil
+}
+
+// IP configs of the result from the addresses of the pod on its interface,
+// with the gateways of its default routes
+func podIPConfigs(link netlink.Link, ips []net.IP, index int, result *current.Result) error {
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", link.Attrs().Name, err)
+	}
+	gateway := func(ip net.IP) net.IP {
+		for _, r := range routes {
+			if r.Dst == nil && r.Gw != nil && (r.Gw.To4() == nil) == (ip.To4() == nil) {
+				return r.Gw
+			}
+		}
+		return nil
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to get IP addresses of %q: %v", link.Attrs().Name, err)
+	}
+	for _, ip := range ips {
+		for _, addr := range addrs {
+			if !addr.IP.Equal(ip) {
+				continue
+			}
+			version := "4"
+			if ip.To4() == nil {
+				version = "6"
+			}
+			result.IPs = append(result.IPs, &current.IPConfig{
+				Version:   version,
+				Interface: current.Int(index),
+				Address:   *addr.IPNet,
+				Gateway:   gateway(ip),
+			})
+		}
+	}
+	if len(result.IPs) == 0 {
+		return fmt.Errorf("%q has none of the addresses of the pod", link.Attrs().Name)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// responder command: run a minimal IKE responder with a test PSK and address
+// pool, so CI and node self-tests can exercise the whole ADD path without a
+// real gateway. charon runs in its own namespace, linked to the host by a veth
+// pair; point serverIP of the plugin config to its address.
+func responderCommand(args []string) error {
+	flags := flag.NewFlagSet("responder", flag.ContinueOnError)
+	psk := flags.String("psk", "test1234", "pre-shared key")
+	pool := flags.String("pool", "10.173.0.0/16", "virtual IP pool handed out to pods")
+	subnet := flags.String("subnet", "10.9.0.0/24", "subnet behind the responder")
+	address := flags.String("address", "10.254.0.2/30", "address of the responder, the host side gets the first address of the subnet")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	addr, err := netlink.ParseIPNet(*address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+
+	netns, err := createTestNetNS("responder")
+	if err != nil {
+		return err
+	}
+	defer deleteTestNetNS("responder", netns)
+
+	if err := linkTestNetNS(netns, "swan-resp", addr, true); err != nil {
+		return err
+	}
+
+	conf := strings.NewReplacer("$Pool$", *pool, "$Subnet$", *subnet).Replace(responderConf)
+	if err := writeTestConfig("responder", conf, fmt.Sprintf("%%any : PSK %s", *psk)); err != nil {
+		return err
+	}
+
+	log.Println(logPrefix, "responder listening on", addr.IP, "with virtual IP pool", *pool)
+	cmd := exec.Command("ip", "netns", "exec", "ns-responder", "ipsec", "start", "--nofork")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		exec.Command("ip", "netns", "exec", "ns-responder", "ipsec", "stop").Run()
+	}()
+	return cmd.Wait()
+}
+
+// Create a named namespace, it's usable by ip netns exec as ns-<name>
+func createTestNetNS(name string) (ns.NetNS, error) {
+	if out, err := exec.Command("ip", "netns", "add", "ns-"+name).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to create namespace %q: %v: %s", name, err, out)
+	}
+	netns, err := ns.GetNS("/var/run/netns/ns-" + name)
+	if err != nil {
+		exec.Command("ip", "netns", "delete", "ns-"+name).Run()
+		return nil, err
+	}
+	return netns, nil
+}
+
+func deleteTestNetNS(name string, netns ns.NetNS) {
+	netns.Close()
+	exec.Command("ip", "netns", "delete", "ns-"+name).Run()
+	os.RemoveAll("/etc/netns/ns-" + name)
+}
+
+// Link netns to the host with a veth pair named <prefix>0 on the host and
+// <prefix>1 in netns. addr goes into netns, the host end gets the first
+// address of the subnet and is the default gateway of netns.
+func linkTestNetNS(netns ns.NetNS, prefix string, addr *net.IPNet, forward bool) error {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: prefix + "0"},
+		PeerName:  prefix + "1",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create veth %q: %v", veth.Name, err)
+	}
+	peer, err := netlink.LinkByName(veth.PeerName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetNsFd(peer, int(netns.Fd())); err != nil {
+		return err
+	}
+
+	gw := &net.IPNet{IP: calcGatewayIP(addr), Mask: addr.Mask}
+	if err := netlink.AddrAdd(veth, &netlink.Addr{IPNet: gw}); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return err
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		peer, err := netlink.LinkByName(veth.PeerName)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(peer, &netlink.Addr{IPNet: addr}); err != nil {
+			return err
+		}
+		for _, name := range []string{"lo", veth.PeerName} {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+		}
+		if err := ip.AddDefaultRoute(gw.IP, peer); err != nil {
+			return err
+		}
+		if forward {
+			return ip.EnableIP4Forward()
+		}
+		return nil
+	})
+}
+
+// Write the ipsec.conf and ipsec.secrets used by charon of a test namespace
+func writeTestConfig(name, conf, secrets string) error {
+	dir := "/etc/netns/ns-" + name
+	if err := os.MkdirAll(dir+"/ipsec.d/run", os.ModePerm); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dir+"/ipsec.conf", []byte(conf), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir+"/ipsec.secrets", []byte(secrets), 0600)
+}
+
+// Accepts both IKE versions, so ikeVersion fallback can be tested too
+const responderConf = `conn %default
+	keyexchange=ike
+	authby=secret
+
+conn responder
+	left=%any
+	leftid=server
+	leftsubnet=$Subnet$,$Pool$
+	right=%any
+	rightsourceip=$Pool$
+	auto=add`
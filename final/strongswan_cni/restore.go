@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Bring back the tunnels of running pods whose charon isn't running, eg:
+// after it crashed or was killed, or after the node rebooted and the runtime
+// restored the pod sandboxes. Without it those pods keep their network but
+// lose the tunnel until they're recreated. Tunnels of pods which are gone
+// are left to be cleaned up by DEL, and drained ones stay closed.
+func restoreTunnels() {
+	unlock, err := lockState()
+	if err != nil {
+		log.Println(logPrefix, "failed to restore tunnels:", err)
+		return
+	}
+	states, err := loadTunnelStates()
+	unlock()
+	if err != nil {
+		log.Println(logPrefix, "failed to restore tunnels:", err)
+		return
+	}
+
+	for _, s := range states {
+		// ADD and restores start charon in the background, it may not
+		// run yet
+		if s.Drained || time.Since(s.Created) < restoreGracePeriod || time.Since(restoredAt[s.ID]) < restoreGracePeriod || charonRunning(s.ID) || tunnelQueued(s.ID) {
+			continue
+		}
+		if !podNetNSAlive(s) {
+			log.Println(logPrefix, "not restoring the tunnel of", s.ContainerID+", its namespace is gone")
+			continue
+		}
+		log.Println(logPrefix, "restoring the tunnel of", s.ContainerID)
+		restoredAt[s.ID] = time.Now()
+		if err := establishIpsec(s); err != nil {
+			log.Println(logPrefix, "failed to restore the tunnel of", s.ContainerID+":", err)
+		}
+	}
+}
+
+// Longer than the bringup script may take to start charon
+const restoreGracePeriod = 2 * time.Minute
+
+// When the daemon last restored each tunnel, only restoreTunnels uses it
+var restoredAt = map[string]time.Time{}
+
+// Whether charon of the pod runs, from its pid file
+func charonRunning(id string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(netnsConfDir(id), "ipsec.d", "run", "charon.pid"))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// Whether the namespace of the pod still exists. Pids, and so
+// /proc/<pid>/ns/net paths, are reused, so it must also hold an address of
+// the pod.
+func podNetNSAlive(s *tunnelState) bool {
+	netns, err := ns.GetNS(s.NetNS)
+	if err != nil {
+		return false
+	}
+	defer netns.Close()
+
+	found := false
+	netns.Do(func(_ ns.NetNS) error {
+		addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			for _, ip := range s.IPs {
+				if addr.IP.Equal(ip) {
+					found = true
+				}
+			}
+		}
+		return nil
+	})
+	return found
+}
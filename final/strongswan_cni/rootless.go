@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+// Rootless runtimes, eg: podman or containerd under rootlesskit, run the
+// plugin in a user namespace: /etc, /var/lib and /var/run/netns of the host
+// can't be written, and the netns path isn't /proc/<pid>/ns/net but a bind
+// mount the runtime owns. There, everything the plugin writes goes under
+// $XDG_RUNTIME_DIR/strongswan-cni, mirroring the usual paths, and commands
+// enter the pod namespace with the nsexec command, from the netns path
+// recorded in the tunnel state, instead of ip netns exec.
+var rootless = inUserNamespace()
+
+func inUserNamespace() bool {
+	data, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	// The initial namespace maps the whole range of uids
+	f := strings.Fields(string(data))
+	return len(f) != 3 || f[0] != "0" || f[1] != "0" || f[2] != "4294967295"
+}
+
+// Where everything goes in rootless mode. Unlike the temporary directory,
+// $XDG_RUNTIME_DIR is private to the user, so nobody else can create the
+// directory first and read the pod secrets from it.
+var rootlessDir = filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "strongswan-cni")
+
+// Where the plugin keeps a file or directory of the host tree, eg:
+// /etc/netns/ns-<id>
+func writablePath(path string) string {
+	if !rootless {
+		return path
+	}
+	return filepath.Join(rootlessDir, path)
+}
+
+// In rootless mode, XDG_RUNTIME_DIR must be set, and it and rootlessDir,
+// created when missing, must be directories of the user only it can access
+func validateRootlessDir() error {
+	if !rootless {
+		return nil
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return fmt.Errorf("XDG_RUNTIME_DIR must be set with rootless runtimes")
+	}
+	if err := os.Mkdir(rootlessDir, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create %q: %v", rootlessDir, err)
+	}
+	for _, dir := range []string{runtimeDir, rootlessDir} {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm()&0077 != 0 {
+			return fmt.Errorf("%q must be a directory owned by uid %d and only accessible to it", dir, os.Getuid())
+		}
+	}
+	return nil
+}
+
+// Per-pod files ip netns exec mounts over /etc: ipsec.conf, ipsec.secrets,
+// ipsec.d and strongswan.conf
+func netnsConfDir(id string) string {
+	return writablePath("/etc/netns/ns-" + id)
+}
+
+// Command line prefix running a command in the namespace of a pod
+func netnsExec(id string) []string {
+	if !rootless {
+		return []string{"ip", "netns", "exec", "ns-" + id}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return []string{exe, "nsexec", id}
+}
+
+func netnsCommand(id string, args ...string) *exec.Cmd {
+	argv := append(netnsExec(id), args...)
+	return exec.Command(argv[0], argv[1:]...)
+}
+
+// nsexec command: what ip netns exec does for a named namespace, for the
+// namespace of a pod: in a private mount namespace, the per-pod files are
+// mounted over /etc, then the command runs in the pod network namespace.
+func nsexecCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: nsexec <id> <command> [args...]")
+	}
+	s, err := loadTunnelState(args[0])
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath(args[1])
+	if err != nil {
+		return err
+	}
+
+	// Namespaces are per thread, the main goroutine is locked to the main
+	// thread, which execs the command
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("failed to unshare the mount namespace: %v", err)
+	}
+	if err := unix.Mount("", "/", "none", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to make / a slave mount: %v", err)
+	}
+	confDir := netnsConfDir(s.ID)
+	files, err := ioutil.ReadDir(confDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		src, dst := filepath.Join(confDir, f.Name()), filepath.Join("/etc", f.Name())
+		if err := unix.Mount(src, dst, "none", unix.MS_BIND, ""); err != nil {
+			log.Println(logPrefix, "failed to mount", src, "over", dst, ":", err)
+		}
+	}
+
+	netns, err := ns.GetNS(s.NetNS)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", s.NetNS, err)
+	}
+	if err := unix.Setns(int(netns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("failed to enter netns %q: %v", s.NetNS, err)
+	}
+	return syscall.Exec(path, args[1:], os.Environ())
+}
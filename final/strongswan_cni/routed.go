@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+)
+
+// How the pods are linked to the host. In routed mode there's no bridge:
+// every pod gets its addresses as /32 and /128, with the host as gateway
+// through its veth, and the host routes each pod address to the veth of the
+// pod. Traffic between local pods is redirected from veth to veth by the
+// tc program of the fast path, the rest follows the host routes. Nothing is
+// switched on the host, so br_netfilter never sees the traffic of the pods,
+// and each pod address maps to a single interface.
+const (
+	datapathBridge = "bridge"
+	datapathRouted = "routed"
+)
+
+// Gateways of the pods in routed mode. The host veths answer ARP for the
+// IPv4 one with proxy ARP and own the IPv6 one.
+var (
+	routedGatewayV4 = net.IPv4(169, 254, 1, 1).To4()
+	routedGatewayV6 = net.ParseIP("fe80::1")
+)
+
+func validateDatapath(datapath string) error {
+	switch datapath {
+	case "", datapathBridge, datapathRouted:
+		return nil
+	}
+	return fmt.Errorf("invalid datapath %q: must be %q or %q", datapath, datapathBridge, datapathRouted)
+}
+
+// Rewrite the IPAM result for routed mode: host addresses, the host as
+// gateway of every route, and a default route for each family. The
+// interfaces of the result are the host veth and the container veth.
+func routeResult(result *current.Result) {
+	var v4, v6 bool
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(1)
+		if ip4 := ipc.Address.IP.To4(); ip4 != nil {
+			ipc.Address = net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+			ipc.Gateway = routedGatewayV4
+			v4 = true
+		} else {
+			ipc.Address.Mask = net.CIDRMask(128, 128)
+			ipc.Gateway = routedGatewayV6
+			v6 = true
+		}
+	}
+
+	var defaultV4, defaultV6 bool
+	for _, r := range result.Routes {
+		r.GW = nil
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			if r.Dst.IP.To4() != nil {
+				defaultV4 = true
+			} else {
+				defaultV6 = true
+			}
+		}
+	}
+	if v4 && !defaultV4 {
+		result.Routes = append(result.Routes, &types.Route{Dst: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}})
+	}
+	if v6 && !defaultV6 {
+		result.Routes = append(result.Routes, &types.Route{Dst: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}})
+	}
+}
+
+// Make the host veth the gateway of the pod and route the pod addresses to
+// it. The routes go away with the veth.
+func setupHostRoutes(h *netlink.Handle, hostVeth string, result *current.Result) error {
+	link, err := h.LinkByName(hostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVeth, err)
+	}
+
+	for _, ipc := range result.IPs {
+		family := netlink.FAMILY_V4
+		if ipc.Address.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		if err := enableIPForward(family); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+
+		if family == netlink.FAMILY_V4 {
+			f := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVeth)
+			if err := ioutil.WriteFile(f, []byte("1"), 0644); err != nil {
+				return fmt.Errorf("failed to enable proxy ARP on %q: %v", hostVeth, err)
+			}
+		} else {
+			addr := &netlink.Addr{
+				IPNet: &net.IPNet{IP: routedGatewayV6, Mask: net.CIDRMask(64, 128)},
+				Flags: syscall.IFA_F_NODAD,
+			}
+			if err := h.AddrAdd(link, addr); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to add %v to %q: %v", routedGatewayV6, hostVeth, err)
+			}
+		}
+
+		dst := ipc.Address
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       &dst,
+		}
+		if err := h.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route '%v dev %v': %v", dst, hostVeth, err)
+		}
+	}
+	return nil
+}
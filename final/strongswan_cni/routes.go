@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/vishvananda/netlink"
+)
+
+// Configure the container interface like ipam.ConfigureIface, except that
+// routes whose gateway isn't within a subnet of the interface, eg: with /32
+// addresses or a gateway on the far side of the bridge, are installed with
+// the onlink flag. The kernel refuses them otherwise. Must run in the
+// container namespace.
+func configureIface(nsh *netlink.Handle, ifName string, result *current.Result) error {
+	var v4gw, v6gw net.IP
+	for _, ipc := range result.IPs {
+		if ipc.Gateway.To4() != nil && v4gw == nil {
+			v4gw = ipc.Gateway
+		} else if ipc.Gateway.To4() == nil && v6gw == nil {
+			v6gw = ipc.Gateway
+		}
+	}
+
+	// Same defaults as ipam.ConfigureIface
+	routeGW := func(r *types.Route) net.IP {
+		switch {
+		case r.GW != nil:
+			return r.GW
+		case r.Dst.IP.To4() != nil:
+			return v4gw
+		}
+		return v6gw
+	}
+
+	onSubnet := func(gw net.IP) bool {
+		for _, ipc := range result.IPs {
+			if ipc.Address.Contains(gw) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var routes, onlink []*types.Route
+	for _, r := range result.Routes {
+		if gw := routeGW(r); gw != nil && !onSubnet(gw) {
+			onlink = append(onlink, r)
+		} else {
+			routes = append(routes, r)
+		}
+	}
+
+	configured := *result
+	configured.Routes = routes
+	if err := ipam.ConfigureIface(ifName, &configured); err != nil {
+		return err
+	}
+	if len(onlink) == 0 {
+		return nil
+	}
+
+	link, err := nsh.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	for _, r := range onlink {
+		gw := routeGW(r)
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       &r.Dst,
+			Gw:        gw,
+			Flags:     int(netlink.FLAG_ONLINK),
+		}
+		if err := nsh.RouteAdd(route); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to add route '%v via %v dev %v onlink': %v", r.Dst, gw, ifName, err)
+		}
+	}
+	return nil
+}
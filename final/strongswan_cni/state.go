@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every tunnel the plugin brings up is recorded in this directory, so we can
+// tell how many of them run on the node and find them again later
+var stateDir = writablePath("/var/lib/cni/strongswan")
+
+type tunnelState struct {
+	ID          string    `json:"id"`
+	ContainerID string    `json:"containerID"`
+	NetNS       string    `json:"netns"`
+	Network     string    `json:"network"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Pod         string    `json:"pod,omitempty"`
+	HostVeth    string    `json:"hostVeth,omitempty"`
+	Bridge      string    `json:"bridge,omitempty"`
+	IPs         []net.IP  `json:"ips,omitempty"`
+	Mark        uint32    `json:"mark,omitempty"`
+	Zone        uint16    `json:"zone,omitempty"`
+	VPN         vpnInfo   `json:"vpn"`
+	AuditLog    string    `json:"auditLog,omitempty"`
+	MetricsDir  string    `json:"metricsDir,omitempty"`
+	Created     time.Time `json:"created"`
+	// Latency of the last IKE handshake, 0 until the first CHILD_SA is up
+	HandshakeSeconds float64 `json:"handshakeSeconds,omitempty"`
+	// nil when charon runs without limits
+	CharonLimits *charonLimits `json:"charonLimits,omitempty"`
+	// charon runs in a transient systemd unit
+	Systemd bool `json:"systemd,omitempty"`
+	// Closed by drain, charon isn't started again until undrain
+	Drained bool `json:"drained,omitempty"`
+}
+
+func tunnelStatePath(id string) string {
+	return filepath.Join(stateDir, id+".json")
+}
+
+func saveTunnelState(s *tunnelState) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tunnelStatePath(s.ID), data, 0600)
+}
+
+func loadTunnelState(id string) (*tunnelState, error) {
+	data, err := ioutil.ReadFile(tunnelStatePath(id))
+	if err != nil {
+		return nil, err
+	}
+	s := &tunnelState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to load tunnel state %q: %v", id, err)
+	}
+	return s, nil
+}
+
+func loadTunnelStates() ([]*tunnelState, error) {
+	files, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var states []*tunnelState
+	for _, f := range files {
+		// The metrics are kept next to the states
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") || f.Name() == metricsFile {
+			continue
+		}
+		s, err := loadTunnelState(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+func removeTunnelState(id string) error {
+	if err := os.Remove(tunnelStatePath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Take an exclusive lock on the state directory, concurrent ADD/DEL must not
+// interleave while counting or changing tunnels. Call the returned func to
+// release it.
+func lockState() (func(), error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(stateDir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %v", stateDir, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Kubernetes passes the namespace and name of the pod in CNI_ARGS, eg:
+// IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0
+func parseK8sArgs(args string) (namespace, pod string) {
+	return k8sArg(args, "K8S_POD_NAMESPACE"), k8sArg(args, "K8S_POD_NAME")
+}
+
+// The value of key in CNI_ARGS, empty when it's missing
+func k8sArg(args, key string) string {
+	for _, kv := range strings.Split(args, ";") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && parts[0] == key {
+			return parts[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestK8sArg(t *testing.T) {
+	args := "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0;K8S_POD_INFRA_CONTAINER_ID=abc;EMPTY=;K8S_POD_UID=a=b"
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{"K8S_POD_NAMESPACE", "default"},
+		{"K8S_POD_NAME", "web-0"},
+		{"K8S_POD_UID", "a=b"},
+		{"EMPTY", ""},
+		{"MISSING", ""},
+		{"K8S_POD", ""},
+	} {
+		if got := k8sArg(args, tc.key); got != tc.want {
+			t.Errorf("k8sArg(%q) = %q, want %q", tc.key, got, tc.want)
+		}
+	}
+	if got := k8sArg("", "K8S_POD_NAME"); got != "" {
+		t.Errorf("k8sArg of empty args = %q", got)
+	}
+	if namespace, pod := parseK8sArgs(args); namespace != "default" || pod != "web-0" {
+		t.Errorf("parseK8sArgs = %q, %q", namespace, pod)
+	}
+}
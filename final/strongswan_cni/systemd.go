@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// With systemd, charon of each pod runs in a transient service created over
+// D-Bus instead of from a nohup'd script: systemd restarts it when it fails,
+// its output goes to the journal under strongswan-cni-<id>, and it's stopped
+// before the network on shutdown. The unit runs starter in the foreground,
+// which runs charon. charonCPU and charonMemory become properties of the unit,
+// since systemd must keep it in its own cgroup.
+const (
+	systemdName    = "org.freedesktop.systemd1"
+	systemdPath    = "/org/freedesktop/systemd1"
+	systemdManager = "org.freedesktop.systemd1.Manager"
+
+	charonRestartDelay = 5 * time.Second
+)
+
+// Waits for the pod interface like the bringup script, charon is then exec'd
+// so systemd tracks starter itself
+const unitIpsecScript = "for r in {1..10}; do %[1]s ip addr | grep -q eth0 && break; sleep 10; done; %[2]s%[3]sexec %[1]s ipsec start --nofork"
+
+// Signatures of the StartTransientUnit arguments: a(sv), a(sasb) and
+// a(sa(sv))
+type unitProperty struct {
+	Name  string
+	Value dbus.Variant
+}
+
+type unitExec struct {
+	Path          string
+	Args          []string
+	IgnoreFailure bool
+}
+
+type unitAux struct {
+	Name       string
+	Properties []unitProperty
+}
+
+func validateCharonUnit(n *NetConf) error {
+	if n.Systemd && rootless {
+		return fmt.Errorf("systemd needs a rootful runtime, rootless ones can't reach the system manager")
+	}
+	return nil
+}
+
+func charonUnit(id string) string {
+	return "strongswan-cni-" + id + ".service"
+}
+
+func connectSystemd() (*dbus.Conn, dbus.BusObject, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the system bus: %v", err)
+	}
+	return conn, conn.Object(systemdName, systemdPath), nil
+}
+
+// Start the unit running charon of the pod, replacing what's left of a
+// previous one, eg: on restores
+func startCharonUnit(s *tunnelState, start, initiate string) error {
+	_, manager, err := connectSystemd()
+	if err != nil {
+		return err
+	}
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		return err
+	}
+	unit := charonUnit(s.ID)
+	stopCharonUnit(s.ID)
+	manager.Call(systemdManager+".ResetFailedUnit", 0, unit)
+
+	nsExec := strings.Join(netnsExec(s.ID), " ")
+	script := fmt.Sprintf(unitIpsecScript, nsExec, start, initiate)
+	description := "strongSwan charon of " + s.ContainerID
+	if s.Pod != "" {
+		description = "strongSwan charon of pod " + s.Namespace + "/" + s.Pod
+	}
+	properties := []unitProperty{
+		{"Description", dbus.MakeVariant(description)},
+		{"ExecStart", dbus.MakeVariant([]unitExec{{bash, []string{"bash", "-c", script}, false}})},
+		{"Restart", dbus.MakeVariant("on-failure")},
+		{"RestartUSec", dbus.MakeVariant(uint64(charonRestartDelay / time.Microsecond))},
+		{"SyslogIdentifier", dbus.MakeVariant(strings.TrimSuffix(unit, ".service"))},
+		// Stopped before the network goes down
+		{"After", dbus.MakeVariant([]string{"network.target"})},
+		// Unloaded once stopped, even when it failed, so the name can be reused
+		{"CollectMode", dbus.MakeVariant("inactive-or-failed")},
+	}
+	if l := s.CharonLimits; l != nil {
+		if l.CPUQuota > 0 {
+			// The quota is for cpuPeriod, in microseconds
+			properties = append(properties, unitProperty{"CPUQuotaPerSecUSec", dbus.MakeVariant(uint64(l.CPUQuota * 1000000 / cpuPeriod))})
+		}
+		if l.Memory > 0 {
+			properties = append(properties, unitProperty{"MemoryMax", dbus.MakeVariant(uint64(l.Memory))})
+		}
+	}
+
+	log.Println(logPrefix, "starting unit", unit, "with", script)
+	var job dbus.ObjectPath
+	if err := manager.Call(systemdManager+".StartTransientUnit", 0, unit, "replace", properties, []unitAux{}).Store(&job); err != nil {
+		return fmt.Errorf("failed to start unit %s: %v", unit, err)
+	}
+	return nil
+}
+
+// Stop the unit of the pod and wait for it to be gone. Nothing to do when
+// systemd doesn't run it, or isn't there at all.
+func stopCharonUnit(id string) {
+	conn, manager, err := connectSystemd()
+	if err != nil {
+		return
+	}
+	unit := charonUnit(id)
+	var job dbus.ObjectPath
+	if err := manager.Call(systemdManager+".StopUnit", 0, unit, "replace").Store(&job); err != nil {
+		if !strings.Contains(err.Error(), "NoSuchUnit") && !strings.Contains(err.Error(), "not loaded") {
+			log.Println(logPrefix, "failed to stop unit", unit, ":", err)
+		}
+		return
+	}
+	for i := 0; i < 100; i++ {
+		var path dbus.ObjectPath
+		if err := manager.Call(systemdManager+".GetUnit", 0, unit).Store(&path); err != nil {
+			// Collected
+			return
+		}
+		state, err := conn.Object(systemdName, path).GetProperty("org.freedesktop.systemd1.Unit.ActiveState")
+		if err != nil || state.Value() == "inactive" || state.Value() == "failed" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Println(logPrefix, "unit", unit, "didn't stop in time")
+}
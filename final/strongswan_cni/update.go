@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// update command: change the connection of a running pod, eg: its remote
+// subnets, PSK or proposals, without recreating it. The settings are read as
+// a JSON object with keys of the vpn object, merged over those of the pod,
+// then ipsec.conf and ipsec.secrets of the pod are rendered again, charon
+// reloads them, and the tunnel is renegotiated with the new settings.
+func updateCommand(args []string) error {
+	flags := flag.NewFlagSet("update", flag.ContinueOnError)
+	file := flags.String("f", "-", "file with the vpn settings to change, - for stdin")
+	renegotiate := flags.Bool("renegotiate", true, "close and initiate the connection again, else the settings apply from the next negotiation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: update [-f file] [-renegotiate=false] <id or container id>")
+	}
+
+	var in io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	patch, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	s, old, err := updateTunnel(flags.Arg(0), patch)
+	if err != nil {
+		return err
+	}
+	log.Println(logPrefix, "updated the connection of", s.ContainerID)
+
+	// The connections are closed before charon reloads ipsec.conf, which
+	// may rename them when ikeVersion changes
+	if *renegotiate {
+		for _, c := range vpnConns(old) {
+			netnsCommand(s.ID, "ipsec", "down", c.name).Run()
+		}
+	}
+	if out, err := netnsCommand(s.ID, "ipsec", "rereadall").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to reload the secrets: %v: %s", err, out)
+	}
+	if out, err := netnsCommand(s.ID, "ipsec", "update").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to reload ipsec.conf: %v: %s", err, out)
+	}
+	if !*renegotiate {
+		return nil
+	}
+	return initiateTunnel(s)
+}
+
+// Merge patch over the vpn settings of the tunnel and render its config
+// again, under the state lock. The previous settings are returned too.
+func updateTunnel(key string, patch []byte) (*tunnelState, vpnInfo, error) {
+	unlock, err := lockState()
+	if err != nil {
+		return nil, vpnInfo{}, err
+	}
+	defer unlock()
+
+	s, err := findTunnelState(key)
+	if err != nil {
+		return nil, vpnInfo{}, err
+	}
+
+	old := s.VPN
+	updated, err := patchVPN(old, patch)
+	if err != nil {
+		return nil, old, err
+	}
+
+	s.VPN = updated
+	if err := genVpnConfig(s); err != nil {
+		return nil, old, err
+	}
+	if err := saveTunnelState(s); err != nil {
+		return nil, old, err
+	}
+	return s, old, nil
+}
+
+// The vpn settings with patch merged over them, when they're valid and none
+// of the frozen ones changed. old is left untouched.
+func patchVPN(old vpnInfo, patch []byte) (vpnInfo, error) {
+	updated := old
+	updated.MinStrength = old.MinStrength.clone()
+	if err := json.Unmarshal(patch, &updated); err != nil {
+		return updated, fmt.Errorf("invalid vpn settings: %v", err)
+	}
+	if err := validateVPN(updated); err != nil {
+		return updated, err
+	}
+	if frozen := frozenVPNSettings(old, updated); len(frozen) > 0 {
+		return updated, fmt.Errorf("%s can't be changed on a running pod, recreate it", strings.Join(frozen, ", "))
+	}
+	return updated, nil
+}
+
+// Find the tunnel of a pod by id or container id, which may be abbreviated
+// like docker does
+func findTunnelState(key string) (*tunnelState, error) {
+	if s, err := loadTunnelState(key); err == nil {
+		return s, nil
+	}
+	states, err := loadTunnelStates()
+	if err != nil {
+		return nil, err
+	}
+	var found *tunnelState
+	for _, s := range states {
+		if strings.HasPrefix(s.ContainerID, key) {
+			if found != nil {
+				return nil, fmt.Errorf("%q matches several containers", key)
+			}
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no tunnel for %q", key)
+	}
+	return found, nil
+}
+
+// Settings applied in the pod namespace or on the host when the pod is
+// added, which charon reloading its config doesn't change, and minStrength,
+// which must not be patched away along with the proposals it allows
+func frozenVPNSettings(old, new vpnInfo) []string {
+	var frozen []string
+	for key, same := range map[string]bool{
+		"serverIP":       old.ServerIP == new.ServerIP,
+		"dscp":           old.DSCP == new.DSCP,
+		"prioritizeIKE":  old.PrioritizeIKE == new.PrioritizeIKE,
+		"left":           old.Left == new.Left,
+		"localInterface": old.LocalIface == new.LocalIface,
+		"forceDNS":       old.ForceDNS == new.ForceDNS,
+		"keepAlive":      old.KeepAlive == new.KeepAlive,
+		"connmark":       old.Connmark == new.Connmark,
+		"vrf":            old.VRF == new.VRF,
+		"markMask":       old.MarkMask == new.MarkMask,
+		"minStrength":    reflect.DeepEqual(old.MinStrength, new.MinStrength),
+	} {
+		if !same {
+			frozen = append(frozen, key)
+		}
+	}
+	sort.Strings(frozen)
+	return frozen
+}
+
+// Initiate the connections of the pod like the bringup script does: with
+// fallback, IKEv1 only once IKEv2 failed
+func initiateTunnel(s *tunnelState) error {
+	if err := markInitiated(s.ID); err != nil {
+		log.Println(logPrefix, "failed to mark", s.ContainerID, "as initiated:", err)
+	}
+	var err error
+	for _, c := range vpnConns(s.VPN) {
+		var out []byte
+		if out, err = netnsCommand(s.ID, "ipsec", "up", c.name).CombinedOutput(); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("failed to initiate %s: %v: %s", c.name, err, out)
+	}
+	return err
+}
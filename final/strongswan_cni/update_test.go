@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFrozenVPNSettings(t *testing.T) {
+	base := vpnInfo{ServerIP: "192.0.2.1", DSCP: "af41", KeepAlive: "20s"}
+	for _, tc := range []struct {
+		name   string
+		change func(*vpnInfo)
+		frozen []string
+	}{
+		{"unchanged", func(*vpnInfo) {}, nil},
+		{"inactivity", func(v *vpnInfo) { v.Inactivity = "5m" }, nil},
+		{"server", func(v *vpnInfo) { v.ServerIP = "192.0.2.2" }, []string{"serverIP"}},
+		{"several", func(v *vpnInfo) { v.VRF = true; v.DSCP = "" }, []string{"dscp", "vrf"}},
+		{"min strength added", func(v *vpnInfo) { v.MinStrength = &cryptoPolicy{MinKeySize: 128} }, []string{"minStrength"}},
+	} {
+		updated := base
+		tc.change(&updated)
+		if frozen := frozenVPNSettings(base, updated); !reflect.DeepEqual(frozen, tc.frozen) {
+			t.Errorf("%s: got %v, want %v", tc.name, frozen, tc.frozen)
+		}
+	}
+}
+
+func TestPatchVPN(t *testing.T) {
+	old := vpnInfo{
+		ServerIP:    "192.0.2.1",
+		PSK:         "secret",
+		IKEProposal: "aes256-sha256-modp2048!",
+		ESPProposal: "aes256-sha256!",
+		MinStrength: &cryptoPolicy{MinKeySize: 128, Forbid: []string{"sha1"}},
+	}
+	for _, tc := range []struct {
+		name  string
+		patch string
+		ok    bool
+	}{
+		{"inactivity", `{"inactivity": "10m"}`, true},
+		{"invalid json", `{"inactivity": 10`, false},
+		{"invalid time", `{"inactivity": "soon"}`, false},
+		{"server", `{"serverIP": "192.0.2.2"}`, false},
+		// Used to be written through the shared pointer into old too, so
+		// the change went unnoticed
+		{"min key size", `{"minStrength": {"minKeySize": 256}}`, false},
+		{"forbid", `{"minStrength": {"forbid": ["sha256"]}}`, false},
+	} {
+		_, err := patchVPN(old, []byte(tc.patch))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+		if old.MinStrength.MinKeySize != 128 || !reflect.DeepEqual(old.MinStrength.Forbid, []string{"sha1"}) {
+			t.Fatalf("%s: patch changed the old settings to %+v", tc.name, *old.MinStrength)
+		}
+	}
+}
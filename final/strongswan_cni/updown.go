@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// charon runs the updown command of the plugin binary, inside the pod
+// namespace, whenever a CHILD_SA of the pod goes up or down. The PLUTO_*
+// environment variables describe the SA. Once done, the default updown
+// script runs so leftfirewall keeps working.
+func updownCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: updown <id>")
+	}
+	s, err := loadTunnelState(args[0])
+	if err != nil {
+		return err
+	}
+
+	verb := os.Getenv("PLUTO_VERB")
+	if strings.HasPrefix(verb, "up-client") {
+		if err := checkNegotiatedStrength(s); err != nil {
+			return err
+		}
+		if err := observeHandshake(s); err != nil {
+			log.Println(logPrefix, "failed to record the IKE handshake of", s.ContainerID+":", err)
+		}
+	}
+	if s.VPN.ForceDNS {
+		if err := updateForcedDNS(verb); err != nil {
+			return err
+		}
+	}
+	if s.VPN.Connmark {
+		if err := updateConnmark(verb); err != nil {
+			return err
+		}
+	}
+	if s.VPN.VRF {
+		if err := updateVRFRoutes(verb); err != nil {
+			return err
+		}
+	}
+	if s.VPN.PolicyPriority > 0 && (strings.HasPrefix(verb, "up-") || strings.HasPrefix(verb, "update-")) {
+		reqid, err := strconv.Atoi(os.Getenv("PLUTO_REQID"))
+		if err != nil {
+			return fmt.Errorf("invalid PLUTO_REQID: %v", err)
+		}
+		if err := setPolicyPriority(s.VPN.PolicyPriority, reqid); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command("ipsec", "_updown", "iptables")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// How often the daemon applies policyPriority again, charon may have rekeyed
+const policyPriorityInterval = 30 * time.Second
+
+// Apply policyPriority again in the namespace of every running pod
+func reapplyPolicyPriorities() {
+	unlock, err := lockState()
+	if err != nil {
+		log.Println(logPrefix, "failed to apply policy priorities:", err)
+		return
+	}
+	states, err := loadTunnelStates()
+	unlock()
+	if err != nil {
+		log.Println(logPrefix, "failed to apply policy priorities:", err)
+		return
+	}
+
+	for _, s := range states {
+		if s.VPN.PolicyPriority == 0 || !charonRunning(s.ID) {
+			continue
+		}
+		netns, err := ns.GetNS(s.NetNS)
+		if err != nil {
+			continue
+		}
+		err = netns.Do(func(_ ns.NetNS) error {
+			return setPolicyPriority(s.VPN.PolicyPriority, 0)
+		})
+		netns.Close()
+		if err != nil {
+			log.Println(logPrefix, "failed to apply the policy priority of", s.ContainerID+":", err)
+		}
+	}
+}
+
+// The updown option of a connection calling the updown command
+func updownOption(id string) string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return fmt.Sprintf(`leftupdown="%s updown %s"`, exe, id)
+}
+
+// Fail closed when the CHILD_SA which just came up uses algorithms below the
+// minimums: its outbound SAs are removed right away, so the traffic of the
+// pod is dropped rather than sent with weak crypto, then the IKE_SA it
+// belongs to is closed: PLUTO_UNIQUEID is the unique id of the IKE_SA, the
+// updown script isn't given the one of the CHILD_SA.
+func checkNegotiatedStrength(s *tunnelState) error {
+	if s.VPN.MinStrength == nil {
+		return nil
+	}
+
+	reqid, err := strconv.Atoi(os.Getenv("PLUTO_REQID"))
+	if err != nil {
+		return fmt.Errorf("invalid PLUTO_REQID: %v", err)
+	}
+	states, err := netlink.XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	var weak error
+	for _, state := range states {
+		if state.Reqid != reqid {
+			continue
+		}
+		if err := s.VPN.MinStrength.checkState(state); err != nil {
+			weak = err
+			break
+		}
+	}
+	if weak == nil {
+		return nil
+	}
+
+	log.Println(logPrefix, "closing IKE_SA of", s.ContainerID+", its CHILD_SA is below minimum strength:", weak)
+	me := os.Getenv("PLUTO_ME")
+	for _, state := range states {
+		if state.Reqid == reqid && state.Src.String() == me {
+			netlink.XfrmStateDel(&state)
+		}
+	}
+
+	// charon is busy running us, close the IKE_SA once we're done
+	down := exec.Command("ipsec", "down", fmt.Sprintf("%s[%s]", os.Getenv("PLUTO_CONNECTION"), os.Getenv("PLUTO_UNIQUEID")))
+	if err := down.Start(); err != nil {
+		return err
+	}
+	return weak
+}
+
+// charon computes the priority of its policies from the size of the traffic
+// selectors, ipsec.conf has no way to fix it. The policies are updated with
+// the configured priority once a CHILD_SA is up or updated, so they rank
+// predictably against the policies of other IPsec users. Lower values win.
+// charon installs its own priority again on rekeys, and trap policies come
+// without a CHILD_SA, so the daemon applies it again periodically, to the
+// policies of every reqid, 0.
+func setPolicyPriority(priority, reqid int) error {
+	policies, err := netlink.XfrmPolicyList(netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		if policy.Priority == priority {
+			continue
+		}
+		for _, tmpl := range policy.Tmpls {
+			if reqid != 0 && tmpl.Reqid != reqid {
+				continue
+			}
+			policy.Priority = priority
+			if err := netlink.XfrmPolicyUpdate(&policy); err != nil {
+				return fmt.Errorf("failed to set priority of policy %v -> %v: %v", policy.Src, policy.Dst, err)
+			}
+			break
+		}
+	}
+	return nil
+}
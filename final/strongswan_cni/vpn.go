@@ -7,6 +7,8 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -20,19 +22,60 @@ const (
 // TODO: Rewrite this to avoid depend on binary ipsec and ip tool on the host
 // We need a way to establish ipsec connection manually with strongswan
 // Maybe need to look into libstrongswan
-func establishIpsec(netNs string, containerId string, vpnInfo vpnInfo) error {
-	netNs = extractProcId(netNs)
-	log.Println(logPrefix, "establish ipsec for", netNs)
+func establishIpsec(s *tunnelState) error {
+	if err := configureIpsec(s); err != nil {
+		return err
+	}
+	return startIpsec(s)
+}
+
+// Write the configuration of charon of the pod
+func configureIpsec(s *tunnelState) error {
+	log.Println(logPrefix, "establish ipsec for", s.ID)
 
-	prepareNetNsDirectory(netNs)
+	prepareNetNsDirectory(s)
 
 	// Finally, generate client VPN configuration
-	if err := genVpnConfig(netNs, vpnInfo); err != nil {
+	if err := genVpnConfig(s); err != nil {
+		return err
+	}
+	if err := genCharonConfig(s); err != nil {
 		return err
 	}
+	// Created again on restores, eg: after a reboot
+	return setupCharonCgroup(s)
+}
 
-	// Everything is ready, we can officially bring up ipsec
-	args := []string{"bash", "-c", fmt.Sprintf(bringupIpsecScript, netNs, netNs), "&>/tmp/nohup.log"}
+// Everything is ready, we can officially bring up ipsec
+func startIpsec(s *tunnelState) error {
+	netNs, vpnInfo := s.ID, s.VPN
+	nsExec := strings.Join(netnsExec(netNs), " ")
+	// The handshake latency is measured from the marker
+	touch := fmt.Sprintf("touch %q; ", handshakeMarker(netNs))
+	start, initiate := touch, ""
+	if connAuto(vpnInfo) != "start" {
+		// Routed or added connections aren't initiated on start,
+		// initiate them right away so the pod gets its virtual IP.
+		// With fallback, IKEv1 is only tried when IKEv2 fails.
+		var ups []string
+		for _, c := range vpnConns(vpnInfo) {
+			ups = append(ups, fmt.Sprintf(initiateIpsecScript, nsExec, c.name))
+		}
+		start, initiate = "", "sleep 3; "+touch+strings.Join(ups, " || ")+"; "
+	}
+	if s.Systemd {
+		if initiate != "" {
+			// In the background, the unit execs starter
+			initiate = "(" + initiate + ") & "
+		}
+		return startCharonUnit(s, start, initiate)
+	}
+	script := fmt.Sprintf(bringupIpsecScript, nsExec, start, initiate)
+	if s.CharonLimits != nil {
+		// charon inherits the cgroup of the script
+		script = fmt.Sprintf("echo $$ > %q; ", filepath.Join(s.CharonLimits.Cgroup, "cgroup.procs")) + script
+	}
+	args := []string{"bash", "-c", script, "&>/tmp/nohup.log"}
 	cmd := exec.Command("nohup", args...)
 	log.Println(logPrefix, "ipsec command", "nohup", args)
 	var out bytes.Buffer
@@ -46,65 +89,292 @@ func establishIpsec(netNs string, containerId string, vpnInfo vpnInfo) error {
 }
 
 // Prepare directory tree for the vpn to run
-func prepareNetNsDirectory(netNs string) {
-	// We're using ip netns, which require the network namespace in /var/run/netns/namespace
-	// docker doesn't do this neither K8S, so we manually extract proc id and create symbol link
-	os.Mkdir("/var/run/netns", os.ModePerm)
-	os.Symlink(fmt.Sprintf("/proc/%s/ns/net", netNs), fmt.Sprintf("/var/run/netns/ns-%s", netNs))
-
+func prepareNetNsDirectory(s *tunnelState) {
+	netNs := s.ID
 	// When charon run, it puts pid file in /etc/ipsec.d/run hence we cannot run multiple instance
 	// Luckily it has a capability to bind mount anything in /etc/netns/namespace/ into /etc/
 	// respectively. We use this trick to create directory hold those pid and socket file
+	os.MkdirAll(netnsConfDir(netNs)+"/ipsec.d/run", os.ModePerm)
+	if rootless {
+		// nsexec enters the namespace from the netns path of the state
+		return
+	}
+
+	// We're using ip netns, which require the network namespace in /var/run/netns/namespace
+	// docker doesn't do this neither K8S, so we create a symbol link to the namespace we got
+	os.Mkdir("/var/run/netns", os.ModePerm)
+	os.Symlink(s.NetNS, fmt.Sprintf("/var/run/netns/ns-%s", netNs))
 	os.Mkdir("/etc/ipsec.d/run", os.ModePerm)
-	os.MkdirAll("/etc/netns/ns-"+netNs+"/ipsec.d/run", os.ModePerm)
-	os.MkdirAll("/etc/netns/ns-"+netNs, os.ModePerm)
 }
 
 // Stop ipsec, clearout namespace/configfile,symbol link that we have set
 func teardownIpsec(netNs string) {
 	netNs = extractProcId(netNs)
 	log.Println(logPrefix, "teardown ipsec for", netNs)
-	exec.Command("ip", "netns", "exec", "ns-"+netNs, "ipsec", "stop").Run()
+	stopCharonUnit(netNs)
+	netnsCommand(netNs, "ipsec", "stop").Run()
+
+	// The configuration holds the pod secrets, don't leave it behind
+	os.RemoveAll(netnsConfDir(netNs))
+	os.Remove("/var/run/netns/ns-" + netNs)
 }
 
 // Generate VPN config for pod
-func genVpnConfig(netNs string, vpnInfo vpnInfo) error {
+func genVpnConfig(s *tunnelState) error {
+	netNs, vpnInfo := s.ID, s.VPN
 	configContent := ipsecConf
+	for _, c := range vpnConns(vpnInfo) {
+		configContent += "\n\n" + genConnConfig(c, s)
+	}
+
+	if err := ioutil.WriteFile(netnsConfDir(netNs)+"/ipsec.conf", []byte(configContent), 0644); err != nil {
+		return err
+	}
+
+	secret := fmt.Sprintf("%%any : PSK %s", vpnInfo.PSK)
+	if vpnInfo.Auth == authCert {
+		if err := issuePodCert(netNs, vpnInfo); err != nil {
+			return err
+		}
+		if err := installGatewayPin(netNs, vpnInfo); err != nil {
+			return err
+		}
+		secret = ": ECDSA pod.key"
+	}
+
+	ipsecSecretPath := netnsConfDir(netNs) + "/ipsec.secrets"
+	if err := ioutil.WriteFile(ipsecSecretPath, []byte(secret), 0644); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const (
+	ikeVersion2         = "ikev2"
+	ikeVersion1         = "ikev1"
+	ikeVersion2Fallback = "ikev2-fallback"
+)
+
+type vpnConn struct {
+	name        string
+	keyExchange string
+}
+
+// Connections to the VPN server, in the order they are tried
+func vpnConns(vpnInfo vpnInfo) []vpnConn {
+	switch vpnInfo.IKEVersion {
+	case ikeVersion1:
+		return []vpnConn{{"home", ikeVersion1}}
+	case ikeVersion2Fallback:
+		return []vpnConn{{"home", ikeVersion2}, {"home-ikev1", ikeVersion1}}
+	}
+	return []vpnConn{{"home", ikeVersion2}}
+}
+
+func validateIKEVersion(vpnInfo vpnInfo) error {
+	switch vpnInfo.IKEVersion {
+	case "", ikeVersion2, ikeVersion1:
+		return nil
+	case ikeVersion2Fallback:
+		if vpnInfo.Inactivity != "" {
+			return fmt.Errorf("inactivity can't be used with ikeVersion %q", ikeVersion2Fallback)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid ikeVersion %q: must be %q, %q or %q", vpnInfo.IKEVersion, ikeVersion2, ikeVersion1, ikeVersion2Fallback)
+}
+
+// Generate the section of a connection
+func genConnConfig(c vpnConn, s *tunnelState) string {
+	netNs, vpnInfo := s.ID, s.VPN
+	ikeLifetime, keyLife := connLifetimes(c.keyExchange, vpnInfo)
+
+	configContent := ipsecConn
+	configContent = strings.Replace(configContent, "$Conn$", c.name, 1)
+	configContent = strings.Replace(configContent, "$KeyExchange$", c.keyExchange, 1)
+	configContent = strings.Replace(configContent, "$IkeLifetime$", ikeLifetime, 1)
+	configContent = strings.Replace(configContent, "$KeyLife$", keyLife, 1)
+	configContent = strings.Replace(configContent, "$AuthBy$", connAuthBy(vpnInfo), 1)
 	configContent = strings.Replace(configContent, "$LeftId$", "@"+netNs, 1)
 	configContent = strings.Replace(configContent, "$ServerIP$", vpnInfo.ServerIP, 1)
 	configContent = strings.Replace(configContent, "$VirtualSubnet$", vpnInfo.VirtualSubnet, 1)
 	configContent = strings.Replace(configContent, "$HostSubnet$", vpnInfo.HostSubnet, 1)
+	configContent = strings.Replace(configContent, "$Auto$", connAuto(vpnInfo), 1)
+	configContent = strings.Replace(configContent, "$ConnOptions$", connOptions(c.keyExchange, s), 1)
+	return configContent
+}
 
-	if err := ioutil.WriteFile("/etc/netns/ns-"+netNs+"/ipsec.conf", []byte(configContent), 0644); err != nil {
-		return err
+// IKEv1 rekeys are expensive, so unless configured they keep strongSwan's
+// defaults instead of the short IKEv2 lifetimes
+func connLifetimes(keyExchange string, vpnInfo vpnInfo) (string, string) {
+	ikeLifetime, keyLife := "60m", "20m"
+	if keyExchange == ikeVersion1 {
+		ikeLifetime, keyLife = "3h", "1h"
 	}
+	if vpnInfo.IKELifetime != "" {
+		ikeLifetime = vpnInfo.IKELifetime
+	}
+	if vpnInfo.KeyLifetime != "" {
+		keyLife = vpnInfo.KeyLifetime
+	}
+	return ikeLifetime, keyLife
+}
 
-	ipsecSecretPath := "/etc/netns/ns-" + netNs + "/ipsec.secrets"
-	if err := ioutil.WriteFile(ipsecSecretPath, []byte(fmt.Sprintf("%%any : PSK %s", vpnInfo.PSK)), 0644); err != nil {
-		return err
+func connAuthBy(vpnInfo vpnInfo) string {
+	if vpnInfo.Auth == authCert {
+		return "pubkey"
+	}
+	return "secret"
+}
+
+// Generate the strongswan.conf of the pod charon, it's mounted over the one
+// of the host like ipsec.conf. Without any pod specific option, charon just
+// uses the host one.
+func genCharonConfig(s *tunnelState) error {
+	charonOptions := ""
+	if s.AuditLog != "" {
+		if err := os.MkdirAll(charonLogDir, 0750); err != nil {
+			return err
+		}
+		charonOptions += strings.Replace(charonAuditLog, "$Path$", charonLogPath(s.ID), 1)
+	}
+	if s.VPN.ForceDNS {
+		charonOptions += charonNoResolve
+	}
+	if s.VPN.Connmark {
+		charonOptions += charonConnmark
+	}
+	if s.VPN.VRF {
+		charonOptions += charonVRF
+	}
+	if s.VPN.KeepAlive != "" {
+		// NAT-T keepalives, 20s by default
+		charonOptions += "\n\tkeep_alive = " + s.VPN.KeepAlive
+	}
+	if charonOptions == "" {
+		return nil
+	}
+
+	configContent := strings.Replace(strongswanConf, "$CharonOptions$", charonOptions, 1)
+	return ioutil.WriteFile(netnsConfDir(s.ID)+"/strongswan.conf", []byte(configContent), 0644)
+}
+
+// Connections with an inactivity timeout are routed, so that trap policies
+// stay installed and bring the CHILD_SA back up on new traffic once it's been
+// closed for being idle. With fallback, connections are initiated one after
+// the other by the bringup script.
+func connAuto(vpnInfo vpnInfo) string {
+	if vpnInfo.IKEVersion == ikeVersion2Fallback {
+		return "add"
+	}
+	if vpnInfo.Inactivity != "" {
+		return "route"
+	}
+	return "start"
+}
+
+// Optional settings of a connection, each on its own line
+func connOptions(keyExchange string, s *tunnelState) string {
+	netNs, vpnInfo := s.ID, s.VPN
+	var options []string
+	if vpnInfo.Inactivity != "" {
+		options = append(options, "inactivity="+vpnInfo.Inactivity)
+	}
+	if vpnInfo.Auth == authCert {
+		options = append(options, "leftcert=pod.crt")
+	}
+	if vpnInfo.GatewayPin != "" {
+		options = append(options, gatewayPinOption(vpnInfo))
+	}
+	if vpnInfo.ForceDNS {
+		options = append(options, "leftdns=%config4,%config6")
+	}
+	if s.Mark != 0 {
+		mark := fmt.Sprintf("%#x/%s", s.Mark, vpnInfo.MarkMask)
+		options = append(options, "set_mark_in="+mark, "set_mark_out="+mark)
+	}
+	if vpnInfo.Connmark {
+		options = append(options, "mark_out=%unique")
+	}
+	if vpnInfo.VRF {
+		ifID := fmt.Sprint(vrfIfID)
+		options = append(options, "if_id_in="+ifID, "if_id_out="+ifID)
+	}
+	ike, esp := vpnInfo.IKEProposal, vpnInfo.ESPProposal
+	if vpnInfo.MinStrength != nil {
+		// The negotiated algorithms are checked by the updown command
+		ike, esp = strictProposal(ike), strictProposal(esp)
+	}
+	options = append(options, updownOption(netNs))
+	if ike != "" {
+		options = append(options, "ike="+proposalFor(keyExchange, ike))
+	}
+	if esp != "" {
+		options = append(options, "esp="+proposalFor(keyExchange, esp))
 	}
 
+	if len(options) == 0 {
+		return ""
+	}
+	return "\n\t" + strings.Join(options, "\n\t")
+}
+
+// IKEv1 has no separate PRF, it's derived from the integrity algorithm, so
+// prf tokens of IKEv2 proposals are dropped
+func proposalFor(keyExchange, proposals string) string {
+	if keyExchange != ikeVersion1 {
+		return proposals
+	}
+
+	var v1 []string
+	for _, proposal := range strings.Split(proposals, ",") {
+		var algs []string
+		for _, alg := range strings.Split(proposal, "-") {
+			if !strings.HasPrefix(alg, "prf") {
+				algs = append(algs, alg)
+			}
+		}
+		v1 = append(v1, strings.Join(algs, "-"))
+	}
+	return strings.Join(v1, ",")
+}
+
+// Validate a duration in ipsec.conf syntax, such as 90s, 20m or 1h
+func validateIpsecTime(name, value string) error {
+	if value != "" && !ipsecTimeRegexp.MatchString(value) {
+		return fmt.Errorf("invalid %s %q: expected a number with an optional s, m, h or d suffix", name, value)
+	}
 	return nil
 }
 
+var ipsecTimeRegexp = regexp.MustCompile(`^[0-9]+[smhd]?$`)
+
 // Extract procid to and use its as namespace in symlink
 //  Example: /proc/27273/ns/net/ -> 27273
+// Runtimes which bind mount the namespaces, eg: rootless ones, give paths
+// like /run/user/1000/netns/cni-1234, whose last element is used instead.
 func extractProcId(netNs string) string {
 	part := strings.Split(netNs, "/")
-	return part[2]
+	if len(part) > 2 && part[1] == "proc" {
+		return part[2]
+	}
+	return netnsIDRegexp.ReplaceAllString(filepath.Base(netNs), "_")
 }
 
+var netnsIDRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
 // When CNI runs, the interface wasn't configured and up yet, we sleep a bit and re-try ten time before give up
-const bringupIpsecScript = "for r in {1..10}; do sleep 10; if ip netns exec ns-%s ip addr | grep eth0; then ip netns exec ns-%s ipsec start >/dev/null 2>&1; break; fi; done"
+const bringupIpsecScript = "for r in {1..10}; do sleep 10; if %[1]s ip addr | grep eth0; then %[2]s%[1]s ipsec start >/dev/null 2>&1; %[3]sbreak; fi; done"
+const initiateIpsecScript = "%s ipsec up %s >/dev/null 2>&1"
 const ipsecConf = `conn %default
-	ikelifetime=60m
-	keylife=20m
 	rekeymargin=3m
-	keyingtries=1
-	keyexchange=ikev2
-	authby=secret
-
-conn home
+	keyingtries=1`
+const ipsecConn = `conn $Conn$
+	keyexchange=$KeyExchange$
+	ikelifetime=$IkeLifetime$
+	keylife=$KeyLife$
+	authby=$AuthBy$
 	left=%any
 	leftsourceip=%config
 	leftid=$LeftId$
@@ -112,4 +382,29 @@ conn home
 	right=$ServerIP$
 	rightsubnet=172.17.0.0/16,$VirtualSubnet$,$HostSubnet$
 	rightid=server
-	auto=start`
+	auto=$Auto$$ConnOptions$`
+
+// strongswan.conf of the pod, the host configuration in strongswan.d is still
+// included, the same way the default strongswan.conf does
+const strongswanConf = `charon {
+	load_modular = yes
+	plugins {
+		include strongswan.d/charon/*.conf
+	}$CharonOptions$
+}
+
+include strongswan.d/*.conf`
+
+// Log what the audit trail is made of: IKE and CHILD_SA events, and the
+// selected proposals
+const charonAuditLog = `
+	filelog {
+		$Path$ {
+			time_format = %Y-%m-%dT%H:%M:%S%z
+			append = yes
+			default = 0
+			ike = 1
+			chd = 1
+			cfg = 2
+		}
+	}`
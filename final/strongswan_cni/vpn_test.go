@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateIpsecTime(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		ok    bool
+	}{
+		{"", true},
+		{"90", true},
+		{"90s", true},
+		{"20m", true},
+		{"1h", true},
+		{"7d", true},
+		{"1.5h", false},
+		{"-20m", false},
+		{"20 m", false},
+		{"20min", false},
+		{"m", false},
+	} {
+		if err := validateIpsecTime("inactivity", tc.value); (err == nil) != tc.ok {
+			t.Errorf("validateIpsecTime(%q): got error %v", tc.value, err)
+		}
+	}
+}
+
+func TestConnAuto(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		vpnInfo vpnInfo
+		want    string
+	}{
+		{"default", vpnInfo{}, "start"},
+		{"inactivity", vpnInfo{Inactivity: "5m"}, "route"},
+		{"fallback", vpnInfo{IKEVersion: ikeVersion2Fallback}, "add"},
+		{"fallback with inactivity", vpnInfo{IKEVersion: ikeVersion2Fallback, Inactivity: "5m"}, "add"},
+	} {
+		if got := connAuto(tc.vpnInfo); got != tc.want {
+			t.Errorf("%s: got auto=%s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
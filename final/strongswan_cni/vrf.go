@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// With vrf, the tunnel of a pod lives in a VRF of its namespace instead of
+// its main routing table. The SAs are bound to an xfrm interface enslaved to
+// the VRF: the virtual IP goes on that interface, the routes to the remote
+// subnets go into the VRF table, through it, and decrypted packets come back
+// on it. The remote subnets may then overlap the cluster CIDR or the subnets
+// of other pods; only the traffic of sockets bound to the VRF, eg: started
+// with ip vrf exec, goes through the tunnel.
+const (
+	vrfName   = "ipsec-vrf"
+	vrfTable  = 1220
+	vrfXfrmIf = "ipsec0"
+	vrfIfID   = 1
+)
+
+// Route the tunnel in the VRF table rather than in charon's routing table
+const charonVRF = `
+	install_routes = no
+	install_virtual_ip_on = ` + vrfXfrmIf
+
+// Create the VRF and its xfrm interface on top of ifName
+func setupVRF(netns ns.NetNS, vpnInfo vpnInfo, ifName string) error {
+	if !vpnInfo.VRF {
+		return nil
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		vrf := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: vrfName}, Table: vrfTable}
+		if err := netlink.LinkAdd(vrf); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create VRF %q: %v", vrfName, err)
+		}
+		if err := netlink.LinkSetUp(vrf); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", vrfName, err)
+		}
+
+		// netlink has no xfrm interfaces yet
+		for _, args := range [][]string{
+			{"link", "add", vrfXfrmIf, "type", "xfrm", "dev", ifName, "if_id", fmt.Sprint(vrfIfID)},
+			{"link", "set", vrfXfrmIf, "master", vrfName, "up"},
+		} {
+			if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to set up %q: %v: %s", vrfXfrmIf, err, out)
+			}
+		}
+		return nil
+	})
+}
+
+// Route the remote subnet of the CHILD_SA going up through the xfrm
+// interface in the VRF table, remove the route of the one going down. Runs
+// in the pod namespace from the updown command.
+func updateVRFRoutes(verb string) error {
+	up := strings.HasPrefix(verb, "up-client")
+	if !up && !strings.HasPrefix(verb, "down-client") {
+		return nil
+	}
+	_, dst, err := net.ParseCIDR(os.Getenv("PLUTO_PEER_CLIENT"))
+	if err != nil {
+		return fmt.Errorf("invalid PLUTO_PEER_CLIENT: %v", err)
+	}
+	link, err := netlink.LinkByName(vrfXfrmIf)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", vrfXfrmIf, err)
+	}
+
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Table:     vrfTable,
+		Src:       net.ParseIP(os.Getenv("PLUTO_MY_SOURCEIP")),
+	}
+	if up {
+		err = netlink.RouteReplace(route)
+	} else if err = netlink.RouteDel(route); err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update route to %v in VRF %q: %v", dst, vrfName, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Webhook alerts for teams without a Prometheus pipeline. The daemon checks
+// the tunnel of every pod periodically and POSTs a webhookEvent as JSON when
+// one which was up goes down, when one fails to come up for several checks
+// in a row, and when one of those comes back up.
+type webhookEvent struct {
+	// down, failed or up
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	ID          string    `json:"id"`
+	ContainerID string    `json:"containerID"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Pod         string    `json:"pod,omitempty"`
+	Network     string    `json:"network"`
+	Peer        string    `json:"peer"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type tunnelHealth struct {
+	up       bool
+	failures int
+	// Whether the last event sent was down or failed
+	alerted bool
+}
+
+type tunnelWatcher struct {
+	url      string
+	failures int
+	client   *http.Client
+	health   map[string]*tunnelHealth
+}
+
+func newTunnelWatcher(url string, failures int) *tunnelWatcher {
+	return &tunnelWatcher{
+		url:      url,
+		failures: failures,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		health:   map[string]*tunnelHealth{},
+	}
+}
+
+// Check the tunnels of the node once and send the events
+func (w *tunnelWatcher) check() {
+	unlock, err := lockState()
+	if err != nil {
+		log.Println(logPrefix, "failed to check tunnels:", err)
+		return
+	}
+	states, err := loadTunnelStates()
+	unlock()
+	if err != nil {
+		log.Println(logPrefix, "failed to check tunnels:", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, s := range states {
+		seen[s.ID] = true
+		// ADD and restores start charon in the background, give it time
+		// to establish the tunnel. Drained tunnels are down on purpose.
+		if s.Drained || time.Since(s.Created) < restoreGracePeriod {
+			continue
+		}
+		h := w.health[s.ID]
+		if h == nil {
+			h = &tunnelHealth{}
+			w.health[s.ID] = h
+		}
+
+		err := tunnelEstablished(s)
+		switch {
+		case err == nil:
+			if h.alerted {
+				w.send("up", s, nil)
+			}
+			*h = tunnelHealth{up: true}
+		case h.up:
+			w.send("down", s, err)
+			*h = tunnelHealth{failures: 1, alerted: true}
+		default:
+			h.failures++
+			if h.failures == w.failures && !h.alerted {
+				w.send("failed", s, fmt.Errorf("not established after %d checks: %v", h.failures, err))
+				h.alerted = true
+			}
+		}
+	}
+	// The pods which were deleted
+	for id := range w.health {
+		if !seen[id] {
+			delete(w.health, id)
+		}
+	}
+}
+
+// Whether a CHILD_SA of the pod is installed, else why not. A routed
+// connection, with inactivity, is idle rather than down while only its trap
+// policies are in place, the tunnel comes back up with the next packet.
+func tunnelEstablished(s *tunnelState) error {
+	if !charonRunning(s.ID) {
+		return fmt.Errorf("charon isn't running")
+	}
+	out, err := netnsCommand(s.ID, "ipsec", "status").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to get the status: %v: %s", err, out)
+	}
+	if strings.Contains(string(out), "INSTALLED") {
+		return nil
+	}
+	if connAuto(s.VPN) == "route" && strings.Contains(string(out), "ROUTED") {
+		return nil
+	}
+	return fmt.Errorf("no CHILD_SA installed")
+}
+
+func (w *tunnelWatcher) send(event string, s *tunnelState, err error) {
+	e := webhookEvent{
+		Event:       event,
+		Time:        time.Now(),
+		ID:          s.ID,
+		ContainerID: s.ContainerID,
+		Namespace:   s.Namespace,
+		Pod:         s.Pod,
+		Network:     s.Network,
+		Peer:        s.VPN.ServerIP,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	log.Println(logPrefix, "tunnel of", s.ContainerID, event+":", e.Error)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println(logPrefix, "failed to send webhook:", err)
+		return
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println(logPrefix, "failed to send webhook:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println(logPrefix, "failed to send webhook:", resp.Status)
+	}
+}
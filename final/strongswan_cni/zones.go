@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Every pod gets its own conntrack zone for the connections it originates,
+// so identical 5-tuples from different pods, common when they all get the
+// same virtual IP, never collide in the host conntrack table. The zone only
+// applies to the original direction, replies coming from the uplink are
+// matched in the default zone.
+const maxConntrackZone = 65535
+
+// Pick the lowest zone not used by another tunnel. The caller holds the
+// state lock.
+func allocateZone(n *NetConf, s *tunnelState, states []*tunnelState) error {
+	if !n.ConntrackZones {
+		return nil
+	}
+	used := make(map[uint16]bool)
+	for _, other := range states {
+		used[other.Zone] = true
+	}
+	for zone := uint16(1); zone < maxConntrackZone; zone++ {
+		if !used[zone] {
+			s.Zone = zone
+			return nil
+		}
+	}
+	return fmt.Errorf("no free conntrack zone left")
+}
+
+func zoneRule(s *tunnelState, ip net.IP) []string {
+	return []string{"-s", ip.String(), "-j", "CT", "--zone-orig", strconv.Itoa(int(s.Zone)),
+		"-m", "comment", "--comment", fmt.Sprintf("strongswan-cni %s", s.ContainerID)}
+}
+
+// Put the connections of the pod in its zone, before conntrack sees them
+func setupConntrackZone(s *tunnelState) error {
+	if s.Zone == 0 {
+		return nil
+	}
+	for _, ip := range s.IPs {
+		ipt, err := markIPTables(ip)
+		if err != nil {
+			return err
+		}
+		if err := ipt.AppendUnique("raw", "PREROUTING", zoneRule(s, ip)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func teardownConntrackZone(s *tunnelState) error {
+	if s.Zone == 0 {
+		return nil
+	}
+	for _, ip := range s.IPs {
+		ipt, err := markIPTables(ip)
+		if err != nil {
+			return err
+		}
+		exists, err := ipt.Exists("raw", "PREROUTING", zoneRule(s, ip)...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := ipt.Delete("raw", "PREROUTING", zoneRule(s, ip)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}